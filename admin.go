@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// adminPathPrefix is the prefix of the paths of the admin API.
+const adminPathPrefix = "/_admin/"
+
+// serveAdmin serves the admin API, which is only enabled when an admin user
+// or password is set:
+//
+//	GET  /_admin/loggers                   lists the open loggers
+//	POST /_admin/loggers/flush?group=GROUP flushes the logger of a log group
+//	POST /_admin/loggers/close?group=GROUP closes the logger of a log group
+//
+// A closed logger is opened again when entries for its log group arrive.
+func (app *App) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	s := app.settings()
+	if s.adminUser == "" && s.adminPass == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+	if !app.requireBasicAuth(w, r, "admin API", s.adminUser, s.adminPass) {
+		return
+	}
+
+	var method string
+	var action func(group string) bool
+	switch r.URL.Path {
+	case adminPathPrefix + "loggers":
+		method = http.MethodGet
+	case adminPathPrefix + "loggers/flush":
+		method, action = http.MethodPost, app.flushLogger
+	case adminPathPrefix + "loggers/close":
+		method, action = http.MethodPost, app.closeLogger
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+	if r.Method != method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("The only accepted request method is " + method))
+		return
+	}
+
+	if action == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"loggers": app.loggerStats()})
+		return
+	}
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The group query parameter is required"))
+		return
+	}
+	if !action(group) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No open logger for log group " + group))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// A loggerStats describes the logger of a log group.
+type loggerStats struct {
+	Group string       `json:"group"`
+	Sinks []queueStats `json:"sinks"`
+}
+
+// loggerStats returns the stats of all the open loggers, sorted by log group.
+func (app *App) loggerStats() []loggerStats {
+	app.mu.Lock()
+	stats := make([]loggerStats, 0, len(app.loggers))
+	for group, l := range app.loggers {
+		s := loggerStats{Group: group, Sinks: []queueStats{}}
+		if f, ok := l.(fanoutLogger); ok {
+			for _, l := range f {
+				if q, ok := l.(*queuedLogger); ok {
+					s.Sinks = append(s.Sinks, q.stats())
+				}
+			}
+		}
+		stats = append(stats, s)
+	}
+	app.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Group < stats[j].Group })
+	return stats
+}
+
+// flushLogger flushes the logger of a log group, and returns false if there
+// is none.
+func (app *App) flushLogger(group string) bool {
+	app.mu.Lock()
+	l, ok := app.loggers[group]
+	app.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if f, ok := l.(flusher); ok {
+		f.Flush()
+	}
+	return true
+}
+
+// closeLogger closes the logger of a log group after writing out the entries
+// it has, and returns false if there is none.
+func (app *App) closeLogger(group string) bool {
+	app.replacing.Lock()
+	app.mu.Lock()
+	l, ok := app.loggers[group]
+	if ok {
+		delete(app.loggers, group)
+		atomic.AddInt64(&app.generation, 1)
+		activeLoggers.With().Dec()
+	}
+	app.mu.Unlock()
+	app.replacing.Unlock()
+	if ok {
+		l.Close()
+	}
+	return ok
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FlushLogger records entries, and how many times it was flushed.
+type FlushLogger struct {
+	ChannelLogger
+	flushes int
+}
+
+func (l *FlushLogger) Flush() {
+	l.flushes++
+}
+
+func (l *FlushLogger) errorCount() int64 {
+	return 3
+}
+
+func newAdminTestApp() (*App, *FlushLogger) {
+	l := &FlushLogger{ChannelLogger: ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}}
+	sinks := []namedSink{{"admin-test", &testSink{l: l}}}
+	app := withSettings(&App{loggers: make(map[string]logger)}, &settings{sinks: sinks, queueSize: 10, adminUser: "admin", adminPass: "secret"})
+	return app, l
+}
+
+func adminRequest(app *App, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminListLoggers(t *testing.T) {
+	app, l := newAdminTestApp()
+	w := app.newEntryWriter()
+	assert.NoError(t, w.write("web", &logparser.LogEntry{Message: "hello"}))
+	<-l.entries
+	_, err := app.logger("api")
+	assert.NoError(t, err)
+
+	res := adminRequest(app, http.MethodGet, "/_admin/loggers")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+	var body struct {
+		Loggers []loggerStats
+	}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+	assert.Len(t, body.Loggers, 2)
+	assert.Equal(t, "api", body.Loggers[0].Group)
+	assert.Nil(t, body.Loggers[0].Sinks[0].LastWrite)
+
+	web := body.Loggers[1]
+	assert.Equal(t, "web", web.Group)
+	assert.Len(t, web.Sinks, 1)
+	s := web.Sinks[0]
+	assert.Equal(t, "admin-test", s.Sink)
+	assert.Equal(t, 0, s.Queued)
+	assert.Equal(t, 10, s.QueueSize)
+	assert.Equal(t, int64(0), s.Dropped)
+	assert.Equal(t, int64(3), *s.Errors)
+	// The last write is recorded right after the entry is passed on.
+	assert.Eventually(t, func() bool {
+		return app.loggerStats()[1].Sinks[0].LastWrite != nil
+	}, time.Second, time.Millisecond)
+	assert.WithinDuration(t, time.Now(), *app.loggerStats()[1].Sinks[0].LastWrite, time.Minute)
+}
+
+func TestAdminFlushLogger(t *testing.T) {
+	app, l := newAdminTestApp()
+	_, err := app.logger("web")
+	assert.NoError(t, err)
+
+	res := adminRequest(app, http.MethodPost, "/_admin/loggers/flush?group=web")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, 1, l.flushes)
+
+	res = adminRequest(app, http.MethodPost, "/_admin/loggers/flush?group=missing")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestAdminCloseLogger(t *testing.T) {
+	app, l := newAdminTestApp()
+	w := app.newEntryWriter()
+	assert.NoError(t, w.write("web", &logparser.LogEntry{Message: "1"}))
+
+	res := adminRequest(app, http.MethodPost, "/_admin/loggers/close?group=web")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, "1", (<-l.entries).Message)
+	assert.True(t, l.closed)
+	assert.Empty(t, app.loggers)
+
+	// Entry writers open a new logger instead of using the closed one.
+	l.closed = false
+	assert.NoError(t, w.write("web", &logparser.LogEntry{Message: "2"}))
+	assert.Equal(t, "2", (<-l.entries).Message)
+	assert.Len(t, app.loggers, 1)
+
+	res = adminRequest(app, http.MethodPost, "/_admin/loggers/close?group=missing")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestAdminInvalidRequests(t *testing.T) {
+	app, _ := newAdminTestApp()
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/_admin/loggers", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/_admin/loggers/flush?group=web", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/_admin/loggers/close", http.StatusBadRequest},
+		{http.MethodGet, "/_admin/nope", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res := adminRequest(app, test.method, test.path)
+		assert.Equal(t, test.status, res.Code, test.path)
+	}
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	app, _ := newAdminTestApp()
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_admin/loggers", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The admin API is disabled without credentials.
+	s := app.settings()
+	s.adminUser, s.adminPass = "", ""
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_admin/loggers", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "Not found"))
+}
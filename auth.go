@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var authFailures = metrics.NewCounterVec(
+	"drain_auth_failures_total",
+	"Requests rejected because of invalid credentials or a lockout.",
+	"reason",
+)
+
+// drainCredentials are the credentials accepted for a single log group. Every
+// configured factor must match: if both a user/password pair and drain tokens
+// are set, a request must carry valid basic auth and a valid drain token.
+type drainCredentials struct {
+	User string `json:"user" yaml:"user"`
+
+	// Pass is the plain text password. PassBcrypt is a bcrypt hash of the
+	// password, and can be used instead of Pass to avoid storing plain text
+	// secrets in the credentials file.
+	Pass       string `json:"pass" yaml:"pass"`
+	PassBcrypt string `json:"pass_bcrypt" yaml:"pass_bcrypt"`
+
+	// Tokens is an allowlist of Logplex-Drain-Token header values.
+	Tokens []string `json:"tokens" yaml:"tokens"`
+}
+
+// loadCredentials reads a JSON file mapping log group names to the
+// credentials accepted for them.
+func loadCredentials(path string) (map[string]drainCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(map[string]drainCredentials)
+	if err := json.NewDecoder(f).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %s", path, err)
+	}
+	for group, c := range creds {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("invalid credentials for %s: %s", group, err)
+		}
+	}
+	return creds, nil
+}
+
+func (c drainCredentials) validate() error {
+	if c.Pass != "" && c.PassBcrypt != "" {
+		return errors.New("only one of pass and pass_bcrypt can be set")
+	}
+	if c.PassBcrypt != "" {
+		if _, err := bcrypt.Cost([]byte(c.PassBcrypt)); err != nil {
+			return fmt.Errorf("pass_bcrypt must be a bcrypt hash: %s", err)
+		}
+	}
+	for _, t := range c.Tokens {
+		if t == "" {
+			return errors.New("tokens must not be empty")
+		}
+	}
+	if c.User == "" && c.Pass == "" && c.PassBcrypt == "" && len(c.Tokens) == 0 {
+		return errors.New("no user, password or tokens given")
+	}
+	return nil
+}
+
+// authenticate checks the credentials of a request for the given log group,
+// and writes an error response if they are invalid or if the client has been
+// locked out after too many failed attempts. It returns whether the request
+// may proceed.
+func (app *App) authenticate(w http.ResponseWriter, r *http.Request, appName string) bool {
+	// Log groups that aren't listed in the credentials file share the global
+	// credentials, and so share their count of failed attempts too, so that
+	// trying other paths doesn't get around the lockout.
+	scope := "app " + appName
+	if _, ok := app.settings().credentials[appName]; !ok {
+		scope = "global credentials"
+	}
+	return app.checkAuth(w, r, "app "+appName, scope, app.authorized(appName, r))
+}
+
+// requireBasicAuth checks that a request carries the given user and password,
+// for endpoints that have credentials of their own. Failures count towards the
+// lockout the same way as for log groups.
+func (app *App) requireBasicAuth(w http.ResponseWriter, r *http.Request, endpoint, user, pass string) bool {
+	u, p, _ := r.BasicAuth()
+	return app.checkAuth(w, r, endpoint, endpoint, drainCredentials{User: user, Pass: pass}.checkBasicAuth(u, p, nil))
+}
+
+// checkAuth writes an error response if the client is locked out or isn't
+// authorized, and keeps track of failed attempts. what names the log group or
+// endpoint in logs, and scope the credentials that were checked.
+//
+// Failed attempts are counted per client address and scope, so that a drain
+// with wrong credentials doesn't lock out the other drains sending from the
+// shared egress addresses of Logplex, and per client address, with a higher
+// limit, so that trying other scopes doesn't get around the lockout.
+func (app *App) checkAuth(w http.ResponseWriter, r *http.Request, what, scope string, authorized bool) bool {
+	s := app.settings()
+	addr := remoteAddr(r, s.trustForwardedFor)
+
+	if d := s.authLimiter.locked(addr, scope); d > 0 {
+		authFailures.With("locked_out").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+
+	if !authorized {
+		authFailures.With("invalid_credentials").Inc()
+		log.Printf("authentication failed for %s from %s\n", what, addr)
+		if s.authLimiter.fail(addr, scope) {
+			log.Printf("locking out %s for %s after too many failed authentication attempts\n", addr, what)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="heroku-cloudwatch-drain"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	s.authLimiter.succeed(addr, scope)
+	return true
+}
+
+// authorized reports whether the request carries valid credentials for the
+// given log group.
+//
+// Log groups listed in the credentials file only accept their own credentials.
+// Other log groups accept the global user and password; when a credentials
+// file is in use, they are rejected unless a global user or password is set.
+func (app *App) authorized(appName string, r *http.Request) bool {
+	s := app.settings()
+	c, ok := s.credentials[appName]
+	if !ok {
+		if s.credentials != nil && s.user == "" && s.pass == "" {
+			return false
+		}
+		c = drainCredentials{User: s.user, Pass: s.pass}
+		user, pass, _ := r.BasicAuth()
+		return c.checkBasicAuth(user, pass, s.passwords)
+	}
+
+	if c.User != "" || c.Pass != "" || c.PassBcrypt != "" {
+		user, pass, _ := r.BasicAuth()
+		if !c.checkBasicAuth(user, pass, s.passwords) {
+			return false
+		}
+	}
+	if len(c.Tokens) > 0 && !c.checkToken(r.Header.Get("Logplex-Drain-Token")) {
+		return false
+	}
+	return true
+}
+
+// authorizedForAny reports whether the request carries valid credentials for
+// any log group, for endpoints that only learn the log groups of a request
+// once they have decoded its body.
+//
+// The credentials for the user of the request are tried before the ones
+// without a user, and at most one bcrypt hash that isn't known to match is
+// compared per request, so that a request can't make the drain compare its
+// password against every hash in the credentials.
+func (app *App) authorizedForAny(r *http.Request) bool {
+	s := app.settings()
+	user, pass, _ := r.BasicAuth()
+	if s.credentials == nil || s.user != "" || s.pass != "" {
+		if (drainCredentials{User: s.user, Pass: s.pass}).checkBasicAuth(user, pass, s.passwords) {
+			return true
+		}
+	}
+	var groups []string
+	for group, c := range s.credentials {
+		if c.User == "" || secureCompare(user, c.User) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := s.credentials[groups[i]].User != "", s.credentials[groups[j]].User != ""
+		if a != b {
+			return a
+		}
+		return groups[i] < groups[j]
+	})
+	compared := false
+	for _, group := range groups {
+		if c := s.credentials[group]; c.PassBcrypt != "" && !s.passwords.known(c.PassBcrypt, pass) {
+			if compared {
+				continue
+			}
+			compared = true
+		}
+		if app.authorized(group, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c drainCredentials) checkBasicAuth(user, pass string, passwords *passwordCache) bool {
+	userOK := secureCompare(user, c.User)
+	var passOK bool
+	if c.PassBcrypt != "" {
+		passOK = passwords.check(c.PassBcrypt, pass)
+	} else {
+		passOK = secureCompare(pass, c.Pass)
+	}
+	return userOK && passOK
+}
+
+// A passwordCache remembers the bcrypt hashes and passwords that matched, by a
+// digest of both, so that every request from a drain doesn't pay for a bcrypt
+// comparison. Only correct passwords are added, and the settings get a new
+// cache when the credentials change, so it doesn't grow beyond the configured
+// credentials. A nil cache remembers nothing.
+type passwordCache struct {
+	verified sync.Map
+}
+
+// known reports whether the password is known to match the hash.
+func (p *passwordCache) known(hash, pass string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.verified.Load(passwordKey(hash, pass))
+	return ok
+}
+
+// check reports whether the password matches the hash.
+func (p *passwordCache) check(hash, pass string) bool {
+	if p.known(hash, pass) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	if p != nil {
+		p.verified.Store(passwordKey(hash, pass), struct{}{})
+	}
+	return true
+}
+
+func passwordKey(hash, pass string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(hash + "\x00" + pass))
+}
+
+func (c drainCredentials) checkToken(token string) bool {
+	ok := false
+	for _, t := range c.Tokens {
+		if secureCompare(token, t) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// secureCompare compares two strings in constant time. Both strings are hashed
+// first so that the comparison doesn't leak their lengths either.
+func secureCompare(given, expected string) bool {
+	a := sha256.Sum256([]byte(given))
+	b := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// remoteAddr returns the address of the client that sent the request. Behind
+// the Heroku router the connection comes from the router, which appends the
+// client address to X-Forwarded-For, so the last address in that header is
+// used when trustForwardedFor is set.
+func remoteAddr(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			addrs := strings.Split(xff, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// addressFailuresFactor is how many times more failed attempts a client
+// address can make across all scopes than in a single one before it is locked
+// out of all of them.
+const addressFailuresFactor = 10
+
+// An authLimiter keeps track of failed authentication attempts per client
+// address and scope, and per client address, and locks out clients that fail
+// too many times in a row. A nil authLimiter never locks anyone out.
+type authLimiter struct {
+	maxFailures int
+	lockout     time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	attempts  map[string]*authAttempts
+	lastSweep time.Time
+}
+
+type authAttempts struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// newAuthLimiter returns an authLimiter that locks out a client address for
+// the lockout duration after maxFailures consecutive failures in a scope, or
+// addressFailuresFactor times as many in all scopes. Failures older than the
+// lockout duration are forgotten. Returns nil if maxFailures is zero.
+func newAuthLimiter(maxFailures int, lockout time.Duration) *authLimiter {
+	if maxFailures <= 0 {
+		return nil
+	}
+	return &authLimiter{
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		now:         time.Now,
+		attempts:    make(map[string]*authAttempts),
+	}
+}
+
+// locked returns the remaining lockout time for the client address in the
+// scope, or zero if it is not locked out.
+func (l *authLimiter) locked(addr, scope string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var d time.Duration
+	for _, key := range []string{scopeKey(addr, scope), addr} {
+		if a, ok := l.attempts[key]; ok && a.lockedUntil.Sub(now) > d {
+			d = a.lockedUntil.Sub(now)
+		}
+	}
+	return d
+}
+
+// fail records a failed attempt for the client address in the scope, and
+// returns true if the address got locked out because of it.
+func (l *authLimiter) fail(addr, scope string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	inScope := l.failKey(scopeKey(addr, scope), l.maxFailures, now)
+	inAll := l.failKey(addr, l.maxFailures*addressFailuresFactor, now)
+	return inScope || inAll
+}
+
+// failKey records a failed attempt for the key, and returns true if the key
+// got locked out after max failures. Must be called with l.mu held.
+func (l *authLimiter) failKey(key string, max int, now time.Time) bool {
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.last) > l.lockout {
+		a = &authAttempts{}
+		l.attempts[key] = a
+	}
+	a.failures++
+	a.last = now
+	if a.failures >= max {
+		a.failures = 0
+		a.lockedUntil = now.Add(l.lockout)
+		return true
+	}
+	return false
+}
+
+// succeed forgets previous failed attempts for the client address in the
+// scope. Failures in all scopes are only forgotten once they are old, so that
+// succeeding in one scope doesn't allow more attempts in others.
+func (l *authLimiter) succeed(addr, scope string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := scopeKey(addr, scope)
+	if a, ok := l.attempts[key]; ok && !a.lockedUntil.After(l.now()) {
+		delete(l.attempts, key)
+	}
+}
+
+func scopeKey(addr, scope string) string {
+	return addr + "\x00" + scope
+}
+
+// sweep removes expired entries, at most once per lockout period. Must be
+// called with l.mu held.
+func (l *authLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.lockout {
+		return
+	}
+	l.lastSweep = now
+	for key, a := range l.attempts {
+		if now.Sub(a.last) > l.lockout && now.After(a.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
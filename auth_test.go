@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{
+		"app": {"user": "me", "pass": "SECRET"},
+		"hashed": {"user": "me", "pass_bcrypt": "$2a$04$NSZKHmqUfJL.GUY3aDlDVOur2pytfeLN9D.cjx5kufZuDRgcUGTbe"},
+		"tokens": {"tokens": ["d.1234"]}
+	}`)
+	f.Close()
+
+	creds, err := loadCredentials(f.Name())
+	assert.NoError(t, err)
+	assert.Len(t, creds, 3)
+	assert.Equal(t, []string{"d.1234"}, creds["tokens"].Tokens)
+}
+
+func TestLoadInvalidCredentials(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{"app": {}}`,
+		`{"app": {"user": "me", "pass": "a", "pass_bcrypt": "b"}}`,
+		`{"app": {"user": "me", "pass_bcrypt": "not a hash"}}`,
+		`{"app": {"user": "me", "pass_bcrypt": "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"}}`,
+		`{"app": {"tokens": [""]}}`,
+	}
+
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "credentials")
+		assert.NoError(t, err)
+		f.WriteString(test)
+		f.Close()
+
+		_, err = loadCredentials(f.Name())
+		assert.Error(t, err, test)
+		os.Remove(f.Name())
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	a := withSettings(&App{}, &settings{
+		user: "global",
+		pass: "GLOBAL",
+		credentials: map[string]drainCredentials{
+			"plain":  {User: "me", Pass: "SECRET"},
+			"hashed": {User: "me", PassBcrypt: "$2a$04$NSZKHmqUfJL.GUY3aDlDVOur2pytfeLN9D.cjx5kufZuDRgcUGTbe"},
+			"token":  {Tokens: []string{"d.1", "d.2"}},
+			"both":   {User: "me", Pass: "SECRET", Tokens: []string{"d.1"}},
+		},
+	})
+
+	request := func(user, pass, token string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, "/", nil)
+		if user != "" || pass != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		if token != "" {
+			r.Header.Set("Logplex-Drain-Token", token)
+		}
+		return r
+	}
+
+	tests := []struct {
+		appName           string
+		user, pass, token string
+		ok                bool
+	}{
+		{"plain", "me", "SECRET", "", true},
+		{"plain", "me", "WRONG", "", false},
+		{"plain", "global", "GLOBAL", "", false},
+		{"hashed", "me", "SECRET", "", true},
+		{"hashed", "me", "0917b13a9091915d54b6336f45909539cce452b3661b21f386418a257883b30a", "", false},
+		{"token", "", "", "d.2", true},
+		{"token", "", "", "d.3", false},
+		{"token", "", "", "", false},
+		{"both", "me", "SECRET", "d.1", true},
+		{"both", "me", "SECRET", "", false},
+		{"both", "", "", "d.1", false},
+		{"other", "global", "GLOBAL", "", true},
+		{"other", "me", "SECRET", "", false},
+	}
+
+	for _, test := range tests {
+		ok := a.authorized(test.appName, request(test.user, test.pass, test.token))
+		assert.Equal(t, test.ok, ok, "%+v", test)
+	}
+
+	s := a.settings()
+	s.user, s.pass = "", ""
+	assert.False(t, a.authorized("other", request("", "", "")))
+
+	s.credentials = nil
+	assert.True(t, a.authorized("other", request("", "", "")))
+}
+
+func TestAuthorizedForAny(t *testing.T) {
+	other, err := bcrypt.GenerateFromPassword([]byte("OTHER"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	a := withSettings(&App{}, &settings{
+		credentials: map[string]drainCredentials{
+			"a":     {PassBcrypt: "$2a$04$NSZKHmqUfJL.GUY3aDlDVOur2pytfeLN9D.cjx5kufZuDRgcUGTbe"},
+			"b":     {PassBcrypt: string(other)},
+			"named": {User: "me", PassBcrypt: string(other)},
+		},
+		passwords: new(passwordCache),
+	})
+
+	request := func(user, pass string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, "/", nil)
+		r.SetBasicAuth(user, pass)
+		return r
+	}
+
+	assert.True(t, a.authorizedForAny(request("", "SECRET")))
+	// Only the hash of the first credentials without a user is compared.
+	assert.False(t, a.authorizedForAny(request("", "OTHER")))
+	// The credentials of the user are tried first.
+	assert.True(t, a.authorizedForAny(request("me", "OTHER")))
+	// Passwords that matched before don't count towards the limit.
+	assert.True(t, a.authorizedForAny(request("", "OTHER")))
+	assert.False(t, a.authorizedForAny(request("me", "WRONG")))
+}
+
+func TestPasswordCacheReload(t *testing.T) {
+	o := &options{sinkNames: "stdout", credentials: map[string]drainCredentials{"app": {User: "me", Pass: "SECRET"}}}
+	s, err := newSettings(o, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, s.passwords)
+
+	same := *o
+	next, err := newSettings(&same, s)
+	assert.NoError(t, err)
+	assert.True(t, s.passwords == next.passwords)
+
+	changed := *o
+	changed.credentials = map[string]drainCredentials{"app": {User: "me", Pass: "CHANGED"}}
+	next, err = newSettings(&changed, s)
+	assert.NoError(t, err)
+	assert.False(t, s.passwords == next.passwords)
+}
+
+func TestAuthLockout(t *testing.T) {
+	now := time.Date(2017, 10, 15, 8, 0, 0, 0, time.UTC)
+	a := withSettings(&App{}, &settings{
+		credentials: map[string]drainCredentials{
+			"app":   {User: "me", Pass: "SECRET"},
+			"other": {User: "other", Pass: "OTHER"},
+		},
+		authLimiter: newAuthLimiter(3, time.Minute),
+	})
+	a.settings().authLimiter.now = func() time.Time { return now }
+
+	requestAs := func(group, user, pass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/"+group, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.SetBasicAuth(user, pass)
+		w := httptest.NewRecorder()
+		a.authenticate(w, r, group)
+		return w
+	}
+	request := func(pass string) *httptest.ResponseRecorder {
+		return requestAs("app", "me", pass)
+	}
+
+	before := authFailures.With("locked_out").Value()
+
+	assert.Equal(t, http.StatusUnauthorized, request("WRONG").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("WRONG").Code)
+	assert.Equal(t, http.StatusOK, request("SECRET").Code)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, request("WRONG").Code)
+	}
+
+	w := request("SECRET")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, authFailures.With("locked_out").Value())
+
+	// Another user doesn't get around the lockout, but other drains sending
+	// from the same address aren't locked out.
+	assert.Equal(t, http.StatusTooManyRequests, requestAs("app", "someone", "SECRET").Code)
+	assert.Equal(t, http.StatusOK, requestAs("other", "other", "OTHER").Code)
+
+	now = now.Add(61 * time.Second)
+	assert.Equal(t, http.StatusOK, request("SECRET").Code)
+}
+
+func TestAuthLockoutGlobalCredentials(t *testing.T) {
+	a := withSettings(&App{}, &settings{
+		user:        "me",
+		pass:        "SECRET",
+		authLimiter: newAuthLimiter(3, time.Minute),
+	})
+
+	requestAs := func(group, user, pass string) int {
+		r := httptest.NewRequest(http.MethodPost, "/"+group, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.SetBasicAuth(user, pass)
+		w := httptest.NewRecorder()
+		a.authenticate(w, r, group)
+		return w.Code
+	}
+
+	// Changing the path and the user on every attempt doesn't get around the
+	// lockout of the global credentials.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, requestAs(fmt.Sprintf("a%d", i), fmt.Sprintf("user%d", i), "WRONG"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, requestAs("a3", "me", "SECRET"))
+}
+
+func TestAuthLockoutAddress(t *testing.T) {
+	credentials := make(map[string]drainCredentials)
+	for i := 0; i <= addressFailuresFactor; i++ {
+		group := fmt.Sprintf("app%d", i)
+		credentials[group] = drainCredentials{User: group, Pass: "SECRET"}
+	}
+	a := withSettings(&App{}, &settings{
+		credentials: credentials,
+		authLimiter: newAuthLimiter(2, time.Minute),
+	})
+
+	request := func(group, pass string) int {
+		r := httptest.NewRequest(http.MethodPost, "/"+group, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.SetBasicAuth(group, pass)
+		w := httptest.NewRecorder()
+		a.authenticate(w, r, group)
+		return w.Code
+	}
+
+	// Failing in many log groups locks out the address from all of them.
+	for i := 0; i < addressFailuresFactor; i++ {
+		group := fmt.Sprintf("app%d", i)
+		assert.Equal(t, http.StatusUnauthorized, request(group, "WRONG"))
+		assert.Equal(t, http.StatusUnauthorized, request(group, "WRONG"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request(fmt.Sprintf("app%d", addressFailuresFactor), "SECRET"))
+}
+
+func TestAuthLimiterForgetsOldFailures(t *testing.T) {
+	now := time.Date(2017, 10, 15, 8, 0, 0, 0, time.UTC)
+	l := newAuthLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	assert.False(t, l.fail("a", "app"))
+	now = now.Add(2 * time.Minute)
+	assert.False(t, l.fail("a", "app"))
+	assert.True(t, l.fail("a", "app"))
+	assert.Equal(t, time.Minute, l.locked("a", "app"))
+	assert.Zero(t, l.locked("a", "other"))
+	assert.Zero(t, l.locked("b", "app"))
+
+	now = now.Add(3 * time.Minute)
+	l.fail("b", "app")
+	assert.Len(t, l.attempts, 2)
+
+	assert.Nil(t, newAuthLimiter(0, time.Minute))
+}
+
+func TestRemoteAddr(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/app", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1")
+
+	assert.Equal(t, "10.0.0.1", remoteAddr(r, false))
+	assert.Equal(t, "192.0.2.1", remoteAddr(r, true))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// An awsClient sends signed requests to an AWS service for which there is no
+// client in the vendored SDK, such as S3.
+type awsClient struct {
+	service  string
+	region   string
+	endpoint *url.URL
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// newAWSClient returns a client for the service. If endpoint is empty, the
+// default endpoint for the service in the region is used.
+func newAWSClient(service, region, endpoint string, creds *credentials.Credentials) (*awsClient, error) {
+	if region == "" {
+		return nil, errors.New("no AWS region configured")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	return &awsClient{
+		service:  service,
+		region:   region,
+		endpoint: u,
+		signer: v4.NewSigner(creds, func(s *v4.Signer) {
+			// The path is escaped in do, and S3 doesn't want it escaped twice.
+			s.DisableURIPathEscaping = true
+		}),
+		client: &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// awsSession returns the region and credentials of a new AWS SDK session,
+// which are picked up from the environment.
+func awsSession() (string, *credentials.Credentials, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", nil, err
+	}
+	var region string
+	if sess.Config.Region != nil {
+		region = *sess.Config.Region
+	}
+	return region, sess.Config.Credentials, nil
+}
+
+// do sends a request, and returns the response body and headers. Responses
+// with a status other than 2xx are returned as an *awsError.
+func (c *awsClient) do(method, path string, query url.Values, header http.Header, body []byte) ([]byte, http.Header, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if _, err = c.signer.Sign(req, bytes.NewReader(body), c.service, c.region, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, newAWSError(resp.StatusCode, b)
+	}
+	return b, resp.Header, nil
+}
+
+// escapePath escapes a path the way AWS expects it to be escaped in the
+// canonical request: everything but unreserved characters and slashes.
+func escapePath(path string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// An awsError is an error response from an AWS service.
+type awsError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// newAWSError parses the error code and message from an XML or JSON error
+// response body.
+func newAWSError(status int, body []byte) *awsError {
+	e := &awsError{StatusCode: status}
+	var xmlErr struct {
+		Code    string
+		Message string
+	}
+	var jsonErr struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if xml.Unmarshal(body, &xmlErr) == nil {
+		e.Code, e.Message = xmlErr.Code, xmlErr.Message
+	} else if json.Unmarshal(body, &jsonErr) == nil {
+		// JSON error types may be prefixed with a namespace, separated by #.
+		e.Code = jsonErr.Type[strings.LastIndex(jsonErr.Type, "#")+1:]
+		e.Message = jsonErr.Message
+	}
+	return e
+}
+
+func (e *awsError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Throttled reports whether the request was rejected because of rate limits.
+func (e *awsError) Throttled() bool {
+	switch e.Code {
+	case "Throttling", "ThrottlingException", "SlowDown", "ProvisionedThroughputExceededException", "RequestLimitExceeded":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *awsError) Temporary() bool {
+	return e.StatusCode >= 500 || e.Throttled()
+}
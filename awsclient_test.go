@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAWSError(t *testing.T) {
+	e := newAWSError(http.StatusServiceUnavailable, []byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+	assert.Equal(t, &awsError{StatusCode: 503, Code: "SlowDown", Message: "Please reduce your request rate."}, e)
+	assert.True(t, e.Throttled())
+	assert.True(t, e.Temporary())
+
+	e = newAWSError(http.StatusBadRequest, []byte(`{"__type":"com.amazonaws.kinesis#ResourceNotFoundException","message":"Stream not found"}`))
+	assert.Equal(t, &awsError{StatusCode: 400, Code: "ResourceNotFoundException", Message: "Stream not found"}, e)
+	assert.False(t, e.Temporary())
+	assert.Equal(t, "ResourceNotFoundException: Stream not found (status 400)", e.Error())
+
+	e = newAWSError(http.StatusBadGateway, nil)
+	assert.Equal(t, "request failed with status 502", e.Error())
+	assert.True(t, e.Temporary())
+}
+
+func TestEscapePath(t *testing.T) {
+	assert.Equal(t, "/logs/group%3Dmy-app%252Frouter/a_b.~c", escapePath("/logs/group=my-app%2Frouter/a_b.~c"))
+}
+
+func TestNewAWSClientRequiresRegion(t *testing.T) {
+	_, err := newAWSClient("s3", "", "", nil)
+	assert.Error(t, err)
+}
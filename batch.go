@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// A batchItem is a log entry encoded for a sink that writes in batches.
+type batchItem struct {
+	data []byte
+	key  string // partition key or similar, if the sink needs one
+}
+
+func (i batchItem) size() int {
+	return len(i.data) + len(i.key)
+}
+
+// A batchLogger encodes entries into items, and collects the items into
+// batches. A batch is flushed once it has maxItems items or maxBytes bytes, or
+// when it has been waiting for the flush interval.
+//
+// The flush function is responsible for retries and for reporting the items
+// it fails to write. Flushes never run concurrently.
+type batchLogger struct {
+	sink     string
+	maxItems int
+	maxBytes int
+	encode   func(e *logparser.LogEntry) (batchItem, error)
+	flush    func(items []batchItem)
+
+	mu    sync.Mutex
+	items []batchItem
+	bytes int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBatchLogger(sink string, maxItems, maxBytes int, interval time.Duration, encode func(e *logparser.LogEntry) (batchItem, error), flush func(items []batchItem)) *batchLogger {
+	l := &batchLogger{
+		sink:     sink,
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		encode:   encode,
+		flush:    flush,
+		done:     make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.ticker(interval)
+	return l
+}
+
+func (l *batchLogger) Log(e *logparser.LogEntry) {
+	item, err := l.encode(e)
+	if err != nil {
+		honeybadger.Notify(err)
+		eventsDropped.With(l.sink).Inc()
+		return
+	}
+	if item.size() > l.maxBytes {
+		eventsDropped.With(l.sink).Inc()
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bytes+item.size() > l.maxBytes {
+		l.flushLocked()
+	}
+	l.items = append(l.items, item)
+	l.bytes += item.size()
+	if len(l.items) >= l.maxItems {
+		l.flushLocked()
+	}
+}
+
+// Flush flushes the pending batch.
+func (l *batchLogger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+}
+
+// Close flushes the pending batch.
+func (l *batchLogger) Close() {
+	close(l.done)
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+}
+
+func (l *batchLogger) ticker(interval time.Duration) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.flushLocked()
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *batchLogger) flushLocked() {
+	if len(l.items) == 0 {
+		return
+	}
+	items := l.items
+	l.items = nil
+	l.bytes = 0
+	l.flush(items)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// BatchRecorder records the batches flushed by a batchLogger.
+type BatchRecorder struct {
+	mu      sync.Mutex
+	batches [][]batchItem
+}
+
+func (r *BatchRecorder) Flush(items []batchItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, items)
+}
+
+func (r *BatchRecorder) Sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func encodeMessage(e *logparser.LogEntry) (batchItem, error) {
+	if e.Message == "" {
+		return batchItem{}, errors.New("empty message")
+	}
+	return batchItem{data: []byte(e.Message)}, nil
+}
+
+func TestBatchLoggerMaxItems(t *testing.T) {
+	r := new(BatchRecorder)
+	l := newBatchLogger("test", 2, 1000, time.Hour, encodeMessage, r.Flush)
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		l.Log(&logparser.LogEntry{Message: m})
+	}
+	assert.Equal(t, []int{2, 2}, r.Sizes())
+	l.Close()
+	assert.Equal(t, []int{2, 2, 1}, r.Sizes())
+}
+
+func TestBatchLoggerMaxBytes(t *testing.T) {
+	r := new(BatchRecorder)
+	l := newBatchLogger("test", 100, 5, time.Hour, encodeMessage, r.Flush)
+	before := eventsDropped.With("test").Value()
+
+	l.Log(&logparser.LogEntry{Message: "abc"})
+	l.Log(&logparser.LogEntry{Message: "de"})
+	l.Log(&logparser.LogEntry{Message: "f"})
+	l.Log(&logparser.LogEntry{Message: "too long"})
+	l.Log(&logparser.LogEntry{Message: ""})
+	l.Close()
+
+	assert.Equal(t, []int{2, 1}, r.Sizes())
+	assert.Equal(t, before+2, eventsDropped.With("test").Value())
+}
+
+func TestBatchLoggerInterval(t *testing.T) {
+	r := new(BatchRecorder)
+	l := newBatchLogger("test", 100, 1000, 20*time.Millisecond, encodeMessage, r.Flush)
+	defer l.Close()
+
+	l.Log(&logparser.LogEntry{Message: "a"})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []int{1}, r.Sizes())
+}
+
+func TestBatchLoggerFlush(t *testing.T) {
+	r := new(BatchRecorder)
+	l := newBatchLogger("test", 100, 1000, time.Hour, encodeMessage, r.Flush)
+	defer l.Close()
+
+	l.Log(&logparser.LogEntry{Message: "a"})
+	l.Flush()
+	assert.Equal(t, []int{1}, r.Sizes())
+	l.Flush()
+	assert.Equal(t, []int{1}, r.Sizes())
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+var requestBytesReceived = metrics.NewCounterVec(
+	"drain_request_bytes_received_total",
+	"Bytes of request bodies as received, before decompression.",
+	"encoding",
+)
+
+var requestBytesDecoded = metrics.NewCounterVec(
+	"drain_request_bytes_decoded_total",
+	"Bytes of request bodies after decompression.",
+	"encoding",
+)
+
+var requestsTooLarge = metrics.NewCounterVec(
+	"drain_requests_too_large_total",
+	"Requests rejected for going over a size limit, by endpoint and limit.",
+	"endpoint", "limit",
+)
+
+// tooLargeMessages are the messages of tooLargeErrors for each limit.
+var tooLargeMessages = map[string]string{
+	"body":         "request body is larger than the limit of %d bytes",
+	"decompressed": "decompressed request body is larger than the limit of %d bytes",
+	"frame":        "frame is longer than the limit of %d bytes",
+	"frames":       "request has more than the limit of %d frames",
+}
+
+// A tooLargeError is returned when a request goes over one of the limits on
+// its size.
+type tooLargeError struct {
+	limit string // a key of tooLargeMessages
+	max   int64
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf(tooLargeMessages[e.limit], e.max)
+}
+
+// An invalidBodyError is returned when a compressed request body turns out to
+// be corrupt while it is being read.
+type invalidBodyError struct {
+	encoding string
+	err      error
+}
+
+func (e *invalidBodyError) Error() string {
+	return fmt.Sprintf("invalid %s body: %s", e.encoding, e.err)
+}
+
+// invalidBody responds with 400 Bad Request and returns true if err is an
+// invalidBodyError. Corrupt bodies are the client's fault, so they aren't
+// reported.
+func invalidBody(w http.ResponseWriter, err error) bool {
+	e, ok := err.(*invalidBodyError)
+	if !ok {
+		return false
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(e.Error()))
+	return true
+}
+
+// decodeBody replaces the body of a request with one that decompresses it
+// according to its Content-Encoding, counts the bytes read from it, and
+// returns a tooLargeError once it goes over the body size limits. It responds
+// with an error and returns false if the body can't be decoded, or is known to
+// be too large up front.
+func (app *App) decodeBody(w http.ResponseWriter, r *http.Request) bool {
+	s := app.settings()
+	if s.maxBodySize > 0 && r.ContentLength > s.maxBodySize {
+		return !app.tooLarge(w, r, &tooLargeError{"body", s.maxBodySize})
+	}
+	if s.maxFrames > 0 {
+		// Logplex tells the number of frames in a request.
+		if n, err := strconv.Atoi(r.Header.Get("Logplex-Msg-Count")); err == nil && n > s.maxFrames {
+			return !app.tooLarge(w, r, &tooLargeError{"frames", int64(s.maxFrames)})
+		}
+	}
+
+	status, err := decodeBody(r, s.maxBodySize, s.maxDecompressedSize)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	return true
+}
+
+// tooLarge responds with 413 Request Entity Too Large and returns true if err
+// is a tooLargeError. The request path and the limit it went over are logged,
+// so that drains sending too much can be found, and counted by endpoint.
+func (app *App) tooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	e, ok := err.(*tooLargeError)
+	if !ok {
+		return false
+	}
+	requestsTooLarge.With(endpoint(r), e.limit).Inc()
+	log.Printf("request to %s rejected: %s\n", r.URL.Path, e)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(e.Error()))
+	return true
+}
+
+// endpoint returns the name of the endpoint that received a request, to label
+// metrics with. The path isn't used, since any client can choose it.
+func endpoint(r *http.Request) string {
+	switch {
+	case r.URL.Path == otlpLogsPath:
+		return "otlp"
+	case strings.HasPrefix(r.URL.Path, jsonPathPrefix):
+		return "json"
+	default:
+		return "logplex"
+	}
+}
+
+// readFrame reads until and including the next newline, like ReadBytes. It
+// returns a tooLargeError without buffering the whole line if the line is
+// longer than maxLength bytes, not counting the newline, unless maxLength is 0.
+func readFrame(r *bufio.Reader, maxLength int) ([]byte, error) {
+	var frame []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if maxLength > 0 {
+			n := len(frame) + len(b)
+			if err == nil {
+				n--
+			}
+			if n > maxLength {
+				return nil, &tooLargeError{"frame", int64(maxLength)}
+			}
+		}
+		frame = append(frame, b...)
+		if err != bufio.ErrBufferFull {
+			return frame, err
+		}
+	}
+}
+
+// decodeBody wraps the body of a request, and returns the status code to
+// respond with if it can't. The body as received is limited to maxSize bytes,
+// and after decompression to maxDecompressedSize bytes. A limit of 0 disables
+// it.
+func decodeBody(r *http.Request, maxSize, maxDecompressedSize int64) (int, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" {
+		encoding = "identity"
+	}
+	// The encoding is checked before it is used as a label of the metrics,
+	// so that clients can't add labels to them.
+	switch encoding {
+	case "identity", "gzip", "x-gzip", "deflate":
+	default:
+		return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %q, must be gzip or deflate", encoding)
+	}
+
+	var received io.Reader = &countingReader{r: r.Body, c: requestBytesReceived.With(encoding)}
+	if maxSize > 0 {
+		received = &limitedReader{r: received, n: maxSize, err: &tooLargeError{"body", maxSize}}
+	}
+	var body io.Reader
+	switch encoding {
+	case "identity":
+		body = received
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(received)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid gzip body: %s", err)
+		}
+		body = gz
+	case "deflate":
+		// The deflate content coding is the zlib format, but some clients
+		// send raw deflate data instead.
+		buf := bufio.NewReader(received)
+		if header, err := buf.Peek(2); err == nil && isZlibHeader(header) {
+			z, err := zlib.NewReader(buf)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Errorf("invalid deflate body: %s", err)
+			}
+			body = z
+		} else {
+			body = flate.NewReader(buf)
+		}
+	}
+	if encoding != "identity" {
+		body = &decompressingReader{r: body, encoding: encoding}
+	}
+
+	if maxDecompressedSize > 0 && encoding != "identity" {
+		body = &limitedReader{r: body, n: maxDecompressedSize, err: &tooLargeError{"decompressed", maxDecompressedSize}}
+	}
+	r.Body = readCloser{
+		Reader: &countingReader{r: body, c: requestBytesDecoded.With(encoding)},
+		Closer: r.Body,
+	}
+	return http.StatusOK, nil
+}
+
+// isZlibHeader reports whether b starts with a zlib header for deflate data.
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A decompressingReader turns the errors a decompressor returns for corrupt
+// data into invalidBodyErrors.
+type decompressingReader struct {
+	r        io.Reader
+	encoding string
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && isCorrupt(err) {
+		err = &invalidBodyError{encoding: r.encoding, err: err}
+	}
+	return n, err
+}
+
+// isCorrupt reports whether a decompressor error means that the data is
+// corrupt or truncated.
+func isCorrupt(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.As(err, &corrupt) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, zlib.ErrChecksum) ||
+		errors.Is(err, zlib.ErrHeader)
+}
+
+// A countingReader adds the number of bytes read to a counter.
+type countingReader struct {
+	r io.Reader
+	c *metrics.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.Add(int64(n))
+	return n, err
+}
+
+// A limitedReader reads at most n bytes, and returns err if there is more to
+// read. Unlike io.LimitedReader, it tells going over the limit apart from the
+// end of the data.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		// Check whether there really is more data.
+		var b [1]byte
+		if n, err := r.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
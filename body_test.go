@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compress(t *testing.T, encoding, s string) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "deflate":
+		w = zlib.NewWriter(&b)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&b, flate.DefaultCompression)
+	}
+	_, err := w.Write([]byte(s))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestCompressedBodies(t *testing.T) {
+	const frame = `89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down`
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate"} {
+		l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+		app := &App{loggers: map[string]logger{"app": l}, parse: logparser.Parse}
+
+		header := strings.TrimPrefix(encoding, "raw-")
+		received := requestBytesReceived.With(header).Value()
+		decoded := requestBytesDecoded.With(header).Value()
+
+		body := compress(t, encoding, frame)
+		req := httptest.NewRequest(http.MethodPost, "/app", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", header)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code, encoding)
+		assert.Equal(t, "heroku[web.1]: State changed from up to down", (<-l.entries).Message)
+
+		assert.Equal(t, int64(len(body)), requestBytesReceived.With(header).Value()-received, encoding)
+		assert.Equal(t, int64(len(frame)), requestBytesDecoded.With(header).Value()-decoded, encoding)
+	}
+}
+
+func TestCompressedBodyLimit(t *testing.T) {
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := withSettings(&App{loggers: map[string]logger{"cron": l}}, &settings{maxDecompressedSize: 100})
+
+	body := `{"message": "` + strings.Repeat("a", 200) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/_json/cron", bytes.NewReader(compress(t, "gzip", body)))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "decompressed request body is larger than the limit of 100 bytes", w.Body.String())
+	assert.Empty(t, l.entries)
+
+	// The limit applies to decompressed bodies only.
+	req = httptest.NewRequest(http.MethodPost, "/_json/cron", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestInvalidContentEncoding(t *testing.T) {
+	app := &App{loggers: map[string]logger{}}
+
+	tests := []struct {
+		encoding, body string
+		status         int
+	}{
+		{"br", "x", http.StatusUnsupportedMediaType},
+		{"gzip", "not gzip", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/app", strings.NewReader(test.body))
+		req.Header.Set("Content-Encoding", test.encoding)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, test.encoding)
+	}
+
+	// Unsupported encodings aren't used as labels of the metrics.
+	for _, v := range []*metrics.CounterVec{requestBytesReceived, requestBytesDecoded} {
+		v.Each(func(values []string, c *metrics.Counter) {
+			assert.NotEqual(t, "br", values[0], v.Name)
+		})
+	}
+}
+
+func TestCorruptCompressedBodies(t *testing.T) {
+	const frame = `89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down`
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate"} {
+		body := compress(t, encoding, frame)
+		truncated := body[:len(body)-6]
+		bodies := [][]byte{truncated}
+		if encoding != "raw-deflate" {
+			// Raw deflate data has no checksum to catch this.
+			corrupt := append([]byte{}, body...)
+			corrupt[len(corrupt)-5] ^= 0xff
+			bodies = append(bodies, corrupt)
+		}
+
+		for _, b := range bodies {
+			for _, path := range []string{"/app", "/_json/app", "/v1/logs"} {
+				app := &App{loggers: map[string]logger{}, parse: logparser.Parse}
+				req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+				req.Header.Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusBadRequest, w.Code, "%s %s", encoding, path)
+			}
+		}
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tooLarge := &tooLargeError{"body", 3}
+
+	b, err := ioutil.ReadAll(&limitedReader{r: strings.NewReader("abc"), n: 3, err: tooLarge})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+
+	_, err = ioutil.ReadAll(&limitedReader{r: strings.NewReader("abcd"), n: 3, err: tooLarge})
+	assert.Equal(t, tooLarge, err)
+}
+
+func TestRequestLimits(t *testing.T) {
+	const frame = "89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down\n"
+
+	tests := []struct {
+		name    string
+		app     func(*App)
+		body    string
+		header  string
+		limit   string
+		message string
+	}{
+		{"body", func(app *App) { app.settings().maxBodySize = 100 }, frame + frame, "", "body", "request body is larger than the limit of 100 bytes"},
+		{"frame length", func(app *App) { app.settings().maxFrameLength = 80 }, frame, "", "frame", "frame is longer than the limit of 80 bytes"},
+		{"frames", func(app *App) { app.settings().maxFrames = 2 }, frame + frame + frame, "", "frames", "request has more than the limit of 2 frames"},
+		{"Logplex-Msg-Count", func(app *App) { app.settings().maxFrames = 2 }, frame, "3", "frames", "request has more than the limit of 2 frames"},
+	}
+	for _, test := range tests {
+		l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+		app := withSettings(&App{loggers: map[string]logger{"limits": l}, parse: logparser.Parse}, &settings{})
+		test.app(app)
+		count := requestsTooLarge.With("logplex", test.limit).Value()
+
+		req := httptest.NewRequest(http.MethodPost, "/limits", strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set("Logplex-Msg-Count", test.header)
+		}
+		// Check the limit while reading too, and not only the Content-Length.
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, test.name)
+		assert.Equal(t, test.message, w.Body.String(), test.name)
+		assert.Equal(t, int64(1), requestsTooLarge.With("logplex", test.limit).Value()-count, test.name)
+		// Frames before the one going over the limit aren't sent either.
+		assert.Len(t, l.entries, 0, test.name)
+	}
+}
+
+func TestRequestLimitsNotReached(t *testing.T) {
+	const frame = "89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down\n"
+
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := withSettings(&App{
+		loggers: map[string]logger{"app": l},
+		parse:   logparser.Parse,
+	}, &settings{
+		maxBodySize:    int64(2 * len(frame)),
+		maxFrameLength: len(frame) - 1,
+		maxFrames:      2,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/app", strings.NewReader(frame+frame))
+	req.Header.Set("Logplex-Msg-Count", "2")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, l.entries, 2)
+}
+
+func TestContentLengthLimit(t *testing.T) {
+	app := withSettings(&App{loggers: map[string]logger{}}, &settings{maxBodySize: 10})
+	req := httptest.NewRequest(http.MethodPost, "/_json/cron", strings.NewReader(`{"message": "too long"}`))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "request body is larger than the limit of 10 bytes", w.Body.String())
+}
+
+func TestJSONLineLimits(t *testing.T) {
+	body := "{\"message\": \"a\"}\n{\"message\": \"b\"}\n"
+
+	_, err := readJSONEntries(strings.NewReader(body), time.Now(), 10, 0)
+	assert.Equal(t, &tooLargeError{"frame", 10}, err)
+
+	_, err = readJSONEntries(strings.NewReader(body), time.Now(), 0, 1)
+	assert.Equal(t, &tooLargeError{"frames", 1}, err)
+
+	entries, err := readJSONEntries(strings.NewReader(body), time.Now(), 16, 2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestReadFrame(t *testing.T) {
+	// A line longer than the buffer is read in pieces.
+	line := strings.Repeat("a", 100)
+	buf := bufio.NewReaderSize(strings.NewReader(line+"\nb"), 16)
+
+	b, err := readFrame(buf, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, line+"\n", string(b))
+	b, err = readFrame(buf, 100)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "b", string(b))
+
+	buf = bufio.NewReaderSize(strings.NewReader(line+"\n"), 16)
+	_, err = readFrame(buf, 99)
+	assert.Equal(t, &tooLargeError{"frame", 99}, err)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/jcxplorer/cwlogger"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+var putLogEventsDuration = metrics.NewHistogramVec(
+	"drain_cloudwatch_put_log_events_duration_seconds",
+	"Time taken by PutLogEvents requests to CloudWatch Logs, counting each attempt.",
+	metrics.DefaultBuckets,
+)
+
+// cloudWatchSink writes log groups to CloudWatch Logs. Log groups and streams
+// are created as needed, and log groups are given the retention, KMS key and
+// tags configured for them when a logger is created. Entries with timestamps
+// CloudWatch Logs doesn't accept are handled by the timestamp policy.
+type cloudWatchSink struct {
+	client     *cloudwatchlogs.CloudWatchLogs
+	oversized  oversizedRules
+	timestamps timestampPolicy
+
+	mu        sync.Mutex // protects retention, logGroups and applied
+	retention int
+	logGroups logGroupRules
+
+	// applied holds the settings last applied to each log group, so that
+	// log groups are only looked up again when their settings change.
+	applied map[string]logGroupSettings
+}
+
+func newCloudWatchSink(c *sinkConfig) (sink, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return newCloudWatchSinkForClient(c, cloudwatchlogs.New(sess)), nil
+}
+
+func newCloudWatchSinkForClient(c *sinkConfig, client *cloudwatchlogs.CloudWatchLogs) *cloudWatchSink {
+	client.Handlers.Retry.PushBack(func(r *request.Request) {
+		if request.IsErrorThrottle(r.Error) {
+			sinkThrottled.With("cloudwatch").Inc()
+		}
+	})
+	// cwlogger sends PutLogEvents requests with the HTTP client of the
+	// client directly, bypassing its handlers, so they are observed by the
+	// transport instead.
+	httpClient := http.DefaultClient
+	if client.Config.HTTPClient != nil {
+		httpClient = client.Config.HTTPClient
+	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	observed := *httpClient
+	observed.Transport = &cloudWatchTransport{next: next}
+	client.Config.HTTPClient = &observed
+
+	return &cloudWatchSink{
+		client:     client,
+		retention:  c.retention,
+		logGroups:  c.logGroups,
+		oversized:  c.oversized,
+		timestamps: c.timestamps,
+		applied:    make(map[string]logGroupSettings),
+	}
+}
+
+// putLogEventsTarget is the X-Amz-Target header of PutLogEvents requests.
+const putLogEventsTarget = "Logs_20140328.PutLogEvents"
+
+// cwloggerRetries are the error codes of PutLogEvents responses that cwlogger
+// sends the batch again for. Any other error drops the batch, and is passed to
+// the ErrorReporter.
+var cwloggerRetries = map[string]bool{
+	"InvalidSequenceTokenException": true,
+	"ThrottlingException":           true,
+	"InternalFailure":               true,
+	"ServiceUnavailable":            true,
+	"ServiceUnavailableException":   true,
+}
+
+// A cloudWatchTransport observes the PutLogEvents requests sent through it.
+// Their latency and throttling are measured, successful requests are recorded
+// in the health of the sink, and the entries of requests that cwlogger won't
+// send again are counted as dropped.
+type cloudWatchTransport struct {
+	next http.RoundTripper
+}
+
+func (t *cloudWatchTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("X-Amz-Target") != putLogEventsTarget {
+		return t.next.RoundTrip(r)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	putLogEventsDuration.With().Observe(time.Since(start).Seconds())
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		healthOf("cloudwatch").succeed()
+		return resp, nil
+	}
+
+	// The response is read, to be given to cwlogger as it was.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var data struct {
+		Code string `json:"__type"`
+	}
+	json.Unmarshal(body, &data)
+	if data.Code == "ThrottlingException" {
+		sinkThrottled.With("cloudwatch").Inc()
+	}
+	if !cwloggerRetries[data.Code] && data.Code != cloudwatchlogs.ErrCodeDataAlreadyAcceptedException {
+		eventsDropped.With("cloudwatch").Add(int64(putLogEventsCount(r)))
+	}
+	return resp, nil
+}
+
+// putLogEventsCount returns the number of events in a PutLogEvents request,
+// or 0 if the body can't be read again.
+func putLogEventsCount(r *http.Request) int {
+	if r.GetBody == nil {
+		return 0
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return 0
+	}
+	defer body.Close()
+	var input struct {
+		LogEvents []json.RawMessage `json:"logEvents"`
+	}
+	json.NewDecoder(body).Decode(&input)
+	return len(input.LogEvents)
+}
+
+// benignCloudWatchError reports whether an error passed to the ErrorReporter
+// of cwlogger isn't a failure to write, because the entries were already
+// written.
+func benignCloudWatchError(err error) bool {
+	e, ok := err.(cwlogger.Error)
+	return ok && e.Code == cloudwatchlogs.ErrCodeDataAlreadyAcceptedException
+}
+
+func (s *cloudWatchSink) logger(group string) (logger, error) {
+	cl := &cloudWatchLogger{
+		sink:      s,
+		group:     group,
+		maxSize:   cloudWatchMaxMessageSize,
+		oversized: s.oversized.policy(group),
+	}
+	l, err := s.newLogger(group, cl)
+	if err != nil {
+		return nil, err
+	}
+	cl.l = l
+	return cl, nil
+}
+
+// newLogger creates a cwlogger for a log group, which counts its errors in
+// cl, and applies the settings of the log group.
+func (s *cloudWatchSink) newLogger(group string, cl *cloudWatchLogger) (*cwlogger.Logger, error) {
+	// cwlogger only sets the retention of log groups it creates, and the
+	// settings of existing log groups are left to reconcile.
+	var retention int
+	s.mu.Lock()
+	if r := s.logGroups.settings(group, s.retention).retention; r != nil {
+		retention = *r
+	}
+	s.mu.Unlock()
+	l, err := cwlogger.New(&cwlogger.Config{
+		LogGroupName: group,
+		Client:       s.client,
+		Retention:    retention,
+		ErrorReporter: func(err error) {
+			if benignCloudWatchError(err) {
+				return
+			}
+			atomic.AddInt64(&cl.errors, 1)
+			healthOf("cloudwatch").fail()
+			err = fmt.Errorf("cloudwatch: failed to write to %s: %s", group, err)
+			honeybadger.Notify(err)
+			log.Println(err)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The settings are applied in the background, since loggers are created
+	// while the app is locked, and entries are still written if the settings
+	// can't be applied.
+	go func() {
+		if err := s.reconcile(group); err != nil {
+			err = fmt.Errorf("cloudwatch: %s", err)
+			honeybadger.Notify(err)
+			log.Println(err)
+		}
+	}()
+	return l, nil
+}
+
+// reconcile applies the retention, KMS key and tags configured for a log
+// group to it, unless they have already been applied.
+func (s *cloudWatchSink) reconcile(group string) error {
+	s.mu.Lock()
+	settings := s.logGroups.settings(group, s.retention)
+	applied, ok := s.applied[group]
+	s.mu.Unlock()
+	if ok && reflect.DeepEqual(applied, settings) {
+		return nil
+	}
+	if err := reconcileLogGroup(s.client, group, settings); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.applied[group] = settings
+	s.mu.Unlock()
+	return nil
+}
+
+// setLogGroups replaces the settings of log groups, for the log groups
+// reconciled from then on.
+func (s *cloudWatchSink) setLogGroups(retention int, rules logGroupRules) {
+	s.mu.Lock()
+	s.retention = retention
+	s.logGroups = rules
+	s.mu.Unlock()
+}
+
+type cloudWatchLogger struct {
+	sink  *cloudWatchSink
+	group string
+	l     *cwlogger.Logger
+
+	// rerouted holds the loggers for the log groups entries with out of
+	// range timestamps are rerouted to. It is only used by Log, which isn't
+	// called concurrently, and by Close.
+	rerouted map[string]*cwlogger.Logger
+
+	// Messages larger than maxSize bytes are split or truncated according
+	// to the oversized policy.
+	maxSize   int
+	oversized string
+
+	errors int64 // accessed atomically
+}
+
+func (l *cloudWatchLogger) Log(e *logparser.LogEntry) {
+	// The entry is shared with the loggers of other sinks, which keep its
+	// original timestamp.
+	c := *e
+	out := l.l
+	if group := l.sink.timestamps.apply(l.group, &c, time.Now()); group != l.group {
+		var err error
+		if out, err = l.reroutedLogger(group); err != nil {
+			eventsDropped.With("cloudwatch").Inc()
+			atomic.AddInt64(&l.errors, 1)
+			err = fmt.Errorf("cloudwatch: failed to create logger for log group %s: %s", group, err)
+			honeybadger.Notify(err)
+			log.Println(err)
+			return
+		}
+	}
+	for _, msg := range fitMessage(c.Message, l.maxSize, l.oversized) {
+		out.Log(c.Time, msg)
+	}
+}
+
+// reroutedLogger returns the logger for a log group entries are rerouted to,
+// creating it if needed.
+func (l *cloudWatchLogger) reroutedLogger(group string) (*cwlogger.Logger, error) {
+	if out, ok := l.rerouted[group]; ok {
+		return out, nil
+	}
+	out, err := l.sink.newLogger(group, l)
+	if err != nil {
+		return nil, err
+	}
+	if l.rerouted == nil {
+		l.rerouted = make(map[string]*cwlogger.Logger)
+	}
+	l.rerouted[group] = out
+	return out, nil
+}
+
+func (l *cloudWatchLogger) errorCount() int64 {
+	return atomic.LoadInt64(&l.errors)
+}
+
+func (l *cloudWatchLogger) Close() {
+	l.l.Close()
+	for _, out := range l.rerouted {
+		out.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcxplorer/cwlogger"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudWatchSinkHealth(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newCloudWatchSinkForClient(&sinkConfig{}, newTestCloudWatchClient(server.URL))
+	h := healthOf("cloudwatch")
+	dropped := eventsDropped.With("cloudwatch").Value()
+
+	write := func() *cloudWatchLogger {
+		l, err := s.logger("app")
+		assert.NoError(t, err)
+		l.Log(&logparser.LogEntry{Time: time.Now(), Message: "entry"})
+		l.Close()
+		return l.(*cloudWatchLogger)
+	}
+
+	start := time.Now()
+	write()
+	fake.mu.Lock()
+	assert.Equal(t, 1, fake.events)
+	fake.mu.Unlock()
+	h.mu.Lock()
+	assert.False(t, h.lastSuccess.Before(start))
+	h.mu.Unlock()
+
+	// Errors cwlogger handles itself, or that mean the entries were already
+	// written, aren't failures.
+	fake.mu.Lock()
+	fake.putErrors = []string{"InvalidSequenceTokenException", "DataAlreadyAcceptedException"}
+	fake.mu.Unlock()
+	l := write()
+	assert.False(t, h.failing(time.Now()))
+	assert.Equal(t, int64(0), l.errorCount())
+	assert.Equal(t, dropped, eventsDropped.With("cloudwatch").Value())
+
+	fake.mu.Lock()
+	fake.putErrors = []string{"InvalidParameterException"}
+	fake.mu.Unlock()
+	l = write()
+	assert.True(t, h.failing(time.Now()))
+	assert.Equal(t, int64(1), l.errorCount())
+	assert.Equal(t, dropped+1, eventsDropped.With("cloudwatch").Value())
+}
+
+func TestCloudWatchSinkRetention(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newCloudWatchSinkForClient(&sinkConfig{retention: 30}, newTestCloudWatchClient(server.URL))
+
+	// The retention is set when the log group is created, before the
+	// settings are reconciled in the background.
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	l.Close()
+	assert.Equal(t, []string{"CreateLogGroup", "PutRetentionPolicy", "CreateLogStream"}, fake.Operations()[:3])
+	fake.mu.Lock()
+	assert.Equal(t, 30, fake.groups["app"].retention)
+	fake.mu.Unlock()
+}
+
+func TestCloudWatchSinkMetrics(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newCloudWatchSinkForClient(&sinkConfig{}, newTestCloudWatchClient(server.URL))
+	counts, _ := putLogEventsDuration.With().Snapshot()
+	requests := counts[len(counts)-1]
+	throttled := sinkThrottled.With("cloudwatch").Value()
+
+	fake.mu.Lock()
+	fake.putErrors = []string{"ThrottlingException"}
+	fake.mu.Unlock()
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "entry"})
+	l.Close()
+
+	// The throttled request is sent again.
+	counts, _ = putLogEventsDuration.With().Snapshot()
+	assert.Equal(t, requests+2, counts[len(counts)-1])
+	assert.Equal(t, throttled+1, sinkThrottled.With("cloudwatch").Value())
+}
+
+func TestBenignCloudWatchError(t *testing.T) {
+	assert.True(t, benignCloudWatchError(cwlogger.Error{Code: "DataAlreadyAcceptedException"}))
+	assert.False(t, benignCloudWatchError(cwlogger.Error{Code: "AccessDeniedException"}))
+	assert.False(t, benignCloudWatchError(errors.New("connection refused")))
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A config is the schema of the YAML configuration file.
+//
+// Each setting corresponds to the command line flag named by its flag tag,
+// prefixed with the flag tags of the sections it is in. The file is applied by
+// setting those flags, so that it is validated the same way as the command
+// line, and flags given on the command line take precedence over it.
+type config struct {
+	Listen   listenConfig   `yaml:"listen"`
+	Auth     authConfig     `yaml:"auth"`
+	Routes   []ruleConfig   `yaml:"routes" flag:"route"`
+	Pipeline pipelineConfig `yaml:"pipeline"`
+	Sinks    sinksConfig    `yaml:"sinks"`
+}
+
+type listenConfig struct {
+	HTTP   *string      `yaml:"http" flag:"bind"`
+	Syslog syslogConfig `yaml:"syslog" flag:"syslog-"`
+}
+
+type syslogConfig struct {
+	TCP         *string      `yaml:"tcp" flag:"tcp"`
+	TLS         *string      `yaml:"tls" flag:"tls"`
+	UDP         *string      `yaml:"udp" flag:"udp"`
+	TLSCert     *string      `yaml:"tls_cert" flag:"tls-cert"`
+	TLSKey      *string      `yaml:"tls_key" flag:"tls-key"`
+	TLSClientCA *string      `yaml:"tls_client_ca" flag:"tls-client-ca"`
+	Group       *string      `yaml:"group" flag:"group"`
+	Rules       []ruleConfig `yaml:"rules" flag:"rule"`
+	GroupParam  *bool        `yaml:"group_param" flag:"group-param"`
+}
+
+type authConfig struct {
+	User              *string   `yaml:"user" flag:"user"`
+	Pass              *string   `yaml:"pass" flag:"pass"`
+	CredentialsFile   *string   `yaml:"credentials_file" flag:"credentials"`
+	MaxFailures       *int      `yaml:"max_failures" flag:"auth-max-failures"`
+	Lockout           *duration `yaml:"lockout" flag:"auth-lockout"`
+	TrustForwardedFor *bool     `yaml:"trust_forwarded_for" flag:"trust-forwarded-for"`
+
+	// Credentials are per log group credentials, in the same form as in
+	// the credentials file.
+	Credentials map[string]drainCredentials `yaml:"credentials"`
+
+	Metrics basicAuthConfig `yaml:"metrics" flag:"metrics-"`
+	Admin   basicAuthConfig `yaml:"admin" flag:"admin-"`
+}
+
+type basicAuthConfig struct {
+	User *string `yaml:"user" flag:"user"`
+	Pass *string `yaml:"pass" flag:"pass"`
+}
+
+type pipelineConfig struct {
+	StripAnsiCodes *bool            `yaml:"strip_ansi_codes" flag:"strip-ansi-codes"`
+	Timestamps     timestampsConfig `yaml:"timestamps" flag:"timestamp-"`
+	Limits         limitsConfig     `yaml:"limits"`
+}
+
+type timestampsConfig struct {
+	Policy *string `yaml:"policy" flag:"policy"`
+	Group  *string `yaml:"group" flag:"group"`
+}
+
+type limitsConfig struct {
+	MaxBodySize         *int64 `yaml:"max_body_size" flag:"max-body-size"`
+	MaxDecompressedSize *int64 `yaml:"max_decompressed_size" flag:"max-decompressed-size"`
+	MaxFrameLength      *int   `yaml:"max_frame_length" flag:"max-frame-length"`
+	MaxFrames           *int   `yaml:"max_frames" flag:"max-frames"`
+}
+
+type sinksConfig struct {
+	Enabled    *sinkList        `yaml:"enabled" flag:"sink"`
+	QueueSize  *int             `yaml:"queue_size" flag:"queue-size"`
+	Color      *bool            `yaml:"color" flag:"color"`
+	CloudWatch cloudWatchConfig `yaml:"cloudwatch"`
+	S3         s3Config         `yaml:"s3" flag:"s3-"`
+	Kinesis    kinesisConfig    `yaml:"kinesis" flag:"kinesis-"`
+	Firehose   firehoseConfig   `yaml:"firehose" flag:"firehose-"`
+	File       fileConfig       `yaml:"file" flag:"file-"`
+	OpenSearch openSearchConfig `yaml:"opensearch" flag:"opensearch-"`
+	Relay      relayConfig      `yaml:"relay" flag:"relay-"`
+}
+
+type cloudWatchConfig struct {
+	Retention       *int              `yaml:"retention" flag:"retention"`
+	OversizedEvents []oversizedConfig `yaml:"oversized_events" flag:"oversized-events"`
+
+	// LogGroups set the retention, KMS key and tags of log groups matching
+	// a pattern. The first matching item wins.
+	LogGroups []logGroupConfig `yaml:"log_groups"`
+}
+
+type logGroupConfig struct {
+	Match     string            `yaml:"match"`
+	Retention *int              `yaml:"retention"`
+	KMSKey    string            `yaml:"kms_key"`
+	Tags      map[string]string `yaml:"tags"`
+}
+
+func (c logGroupConfig) rule() logGroupRule {
+	return logGroupRule{
+		pattern:          c.Match,
+		logGroupSettings: logGroupSettings{retention: c.Retention, kmsKey: c.KMSKey, tags: c.Tags},
+	}
+}
+
+type s3Config struct {
+	Bucket        *string   `yaml:"bucket" flag:"bucket"`
+	Prefix        *string   `yaml:"prefix" flag:"prefix"`
+	Endpoint      *string   `yaml:"endpoint" flag:"endpoint"`
+	MaxObjectSize *int64    `yaml:"max_object_size" flag:"max-object-size"`
+	MaxObjectAge  *duration `yaml:"max_object_age" flag:"max-object-age"`
+}
+
+// The flush interval of the kinesis sink applies to the firehose sink too.
+type kinesisConfig struct {
+	Stream        *string   `yaml:"stream" flag:"stream"`
+	Endpoint      *string   `yaml:"endpoint" flag:"endpoint"`
+	FlushInterval *duration `yaml:"flush_interval" flag:"flush-interval"`
+}
+
+type firehoseConfig struct {
+	Stream   *string `yaml:"stream" flag:"stream"`
+	Endpoint *string `yaml:"endpoint" flag:"endpoint"`
+}
+
+type fileConfig struct {
+	Dir      *string   `yaml:"dir" flag:"dir"`
+	Format   *string   `yaml:"format" flag:"format"`
+	MaxSize  *int64    `yaml:"max_size" flag:"max-size"`
+	MaxAge   *duration `yaml:"max_age" flag:"max-age"`
+	MaxFiles *int      `yaml:"max_files" flag:"max-files"`
+	Compress *bool     `yaml:"compress" flag:"compress"`
+}
+
+type openSearchConfig struct {
+	URL           *string   `yaml:"url" flag:"url"`
+	IndexPrefix   *string   `yaml:"index_prefix" flag:"index-prefix"`
+	FlushInterval *duration `yaml:"flush_interval" flag:"flush-interval"`
+}
+
+type relayConfig struct {
+	URLs          []string  `yaml:"urls" flag:"url"`
+	FlushInterval *duration `yaml:"flush_interval" flag:"flush-interval"`
+}
+
+// A ruleConfig sends entries that match to a log group, as a route or a
+// syslog rule.
+type ruleConfig struct {
+	Match string `yaml:"match"`
+	Group string `yaml:"group"`
+}
+
+func (r ruleConfig) String() string {
+	return r.Match + "=" + r.Group
+}
+
+type oversizedConfig struct {
+	Group  string `yaml:"group"`
+	Policy string `yaml:"policy"`
+}
+
+func (r oversizedConfig) String() string {
+	return r.Group + "=" + r.Policy
+}
+
+// sinkList is a list of sink names, which is given as a comma separated list
+// on the command line.
+type sinkList []string
+
+func (l sinkList) String() string {
+	return strings.Join(l, ",")
+}
+
+// A duration is a time.Duration written as a string such as "5m".
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := time.ParseDuration(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", n.Line, err)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// loadConfig reads and validates a configuration file.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// parseConfig parses a configuration file, after replacing environment
+// variables in it, and checks that it only has known settings.
+func parseConfig(b []byte) (*config, error) {
+	c := new(config)
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		// The file is empty.
+		return c, nil
+	}
+	if err := interpolate(&doc); err != nil {
+		return nil, err
+	}
+	if err := checkSettings(&doc, reflect.TypeOf(c), ""); err != nil {
+		return nil, err
+	}
+	if err := doc.Decode(c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var envVarRegexp = regexp.MustCompile(`\$(\$|\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\})`)
+
+// interpolate replaces ${VAR} in the values of the document with the value of
+// the environment variable VAR, and ${VAR:-DEFAULT} with DEFAULT if VAR is not
+// set or empty. $$ stands for a single $. Values that were not quoted are
+// typed after the variables are replaced, so that numbers and booleans can be
+// given with variables too.
+func interpolate(n *yaml.Node) error {
+	if n.Kind != yaml.ScalarNode {
+		for _, c := range n.Content {
+			if err := interpolate(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	v := envVarRegexp.ReplaceAllStringFunc(n.Value, func(s string) string {
+		m := envVarRegexp.FindStringSubmatch(s)
+		if m[1] == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(m[2])
+		if v == "" && m[3] != "" {
+			return m[4]
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("line %d: environment variable %s is not set", n.Line, m[2])
+		}
+		return v
+	})
+	if v != n.Value {
+		n.Value = v
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+	}
+	return err
+}
+
+// checkSettings returns an error for the first setting in the document that
+// isn't part of the schema of t.
+func checkSettings(n *yaml.Node, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var err error
+	switch {
+	case n.Kind == yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err = checkSettings(c, t, path); err != nil {
+				break
+			}
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		for i := 0; i+1 < len(n.Content) && err == nil; i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			f, ok := settingField(t, k.Value)
+			if !ok {
+				return fmt.Errorf("line %d: unknown setting %s%s", k.Line, path, k.Value)
+			}
+			err = checkSettings(v, f.Type, path+k.Value+".")
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content) && err == nil; i += 2 {
+			err = checkSettings(n.Content[i+1], t.Elem(), path+n.Content[i].Value+".")
+		}
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, c := range n.Content {
+			if err = checkSettings(c, t.Elem(), path); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// settingField returns the field of the struct type t for a setting.
+func settingField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if yamlName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// validate checks the settings that don't correspond to a single flag.
+func (c *config) validate() error {
+	if c.Auth.Credentials != nil && c.Auth.CredentialsFile != nil {
+		return errors.New("only one of auth.credentials and auth.credentials_file can be set")
+	}
+	for group, creds := range c.Auth.Credentials {
+		if err := creds.validate(); err != nil {
+			return fmt.Errorf("invalid credentials for %s: %s", group, err)
+		}
+	}
+	for i, lg := range c.Sinks.CloudWatch.LogGroups {
+		if err := lg.rule().validate(); err != nil {
+			return fmt.Errorf("sinks.cloudwatch.log_groups[%d]: %s", i, err)
+		}
+	}
+	if c.Sinks.Enabled != nil {
+		for _, name := range *c.Sinks.Enabled {
+			if _, ok := sinkTypes[name]; !ok {
+				return fmt.Errorf("sinks.enabled: unknown sink %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// apply sets the flags for the settings in the configuration file, except for
+// the flags given on the command line. The per log group credentials are used
+// unless a credentials file is given on the command line, and the log group
+// settings, which have no flags, are always used.
+func (c *config) apply(fs *flag.FlagSet, o *options) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	if err := setFlags(fs, given, reflect.ValueOf(c).Elem(), "", ""); err != nil {
+		return err
+	}
+	if c.Auth.Credentials != nil && !given["credentials"] {
+		o.credentials = c.Auth.Credentials
+	}
+	for _, lg := range c.Sinks.CloudWatch.LogGroups {
+		o.sink.logGroups = append(o.sink.logGroups, lg.rule())
+	}
+	return nil
+}
+
+// setFlags sets the flags for the fields of the struct v that have a value.
+// Repeatable flags are set once for each item of a list.
+func setFlags(fs *flag.FlagSet, given map[string]bool, v reflect.Value, path, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		key := path + yamlName(f)
+		name, ok := f.Tag.Lookup("flag")
+		if fv.Kind() == reflect.Struct {
+			if err := setFlags(fs, given, fv, key+".", prefix+name); err != nil {
+				return err
+			}
+			continue
+		}
+		name = prefix + name
+		if !ok || given[name] {
+			continue
+		}
+
+		switch fv.Kind() {
+		case reflect.Ptr:
+			if fv.IsNil() {
+				continue
+			}
+			if err := fs.Set(name, fmt.Sprint(fv.Elem().Interface())); err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+		case reflect.Slice:
+			for j := 0; j < fv.Len(); j++ {
+				if err := fs.Set(name, fmt.Sprint(fv.Index(j).Interface())); err != nil {
+					return fmt.Errorf("%s[%d]: %s", key, j, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exampleConfig = `
+listen:
+  http: ":${PORT:-8080}"
+  syslog:
+    tls: ":6514"
+    tls_cert: /etc/drain/tls.crt
+    tls_key: /etc/drain/tls.key
+    group: legacy
+    rules:
+      - match: 10.0.0.0/8
+        group: internal
+    group_param: true
+
+auth:
+  user: drain
+  pass: ${DRAIN_PASS}
+  max_failures: 5
+  lockout: 10m
+  trust_forwarded_for: true
+  credentials:
+    billing:
+      user: billing
+      pass_bcrypt: $2a$04$qqD/u7u4X7iw.TI6J/8MIukG8GVdtp1eTk5BRkv0ejq21wLsCbDh.
+  metrics:
+    user: prometheus
+    pass: ${METRICS_PASS}
+  admin:
+    pass: ${ADMIN_PASS:-}
+
+routes:
+  - match: heroku/router
+    group: "{group}/router"
+
+pipeline:
+  strip_ansi_codes: true
+  timestamps:
+    policy: reroute
+    group: "{group}/late"
+  limits:
+    max_body_size: 1048576
+    max_frames: 500
+
+sinks:
+  enabled: [cloudwatch, s3]
+  queue_size: ${QUEUE_SIZE}
+  cloudwatch:
+    retention: 30
+    oversized_events:
+      - group: "batch-*"
+        policy: truncate
+    log_groups:
+      - match: "billing*"
+        retention: 365
+        kms_key: arn:aws:kms:us-east-1:123456789012:key/abcd
+        tags:
+          team: payments
+  s3:
+    bucket: my-logs
+    max_object_age: 5m
+  relay:
+    urls:
+      - https://logs.example.com/{group}
+`
+
+func writeConfig(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "drain")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	return path
+}
+
+func TestParseOptionsConfig(t *testing.T) {
+	t.Setenv("DRAIN_PASS", "s3cr3t$")
+	t.Setenv("METRICS_PASS", "metrics")
+	t.Setenv("QUEUE_SIZE", "500")
+	path := writeConfig(t, exampleConfig)
+
+	o, err := parseOptions("drain", []string{"-config", path}, flag.ContinueOnError)
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", o.bind)
+	assert.Equal(t, ":6514", o.syslogTLS)
+	assert.Equal(t, "legacy", o.syslogGroup)
+	assert.Equal(t, "10.0.0.0/8=internal", o.syslogRules.String())
+	assert.True(t, o.syslogGroupParam)
+	assert.Equal(t, "drain", o.user)
+	assert.Equal(t, "s3cr3t$", o.pass)
+	assert.Equal(t, 5, o.authMaxFailures)
+	assert.Equal(t, 10*time.Minute, o.authLockout)
+	assert.True(t, o.trustForwardedFor)
+	assert.Equal(t, "billing", o.credentials["billing"].User)
+	assert.Equal(t, "$2a$04$qqD/u7u4X7iw.TI6J/8MIukG8GVdtp1eTk5BRkv0ejq21wLsCbDh.", o.credentials["billing"].PassBcrypt)
+	assert.Equal(t, "prometheus", o.metricsUser)
+	assert.Equal(t, "metrics", o.metricsPass)
+	assert.Equal(t, "", o.adminPass)
+	assert.Equal(t, "heroku/router={group}/router", o.routes.String())
+	assert.True(t, o.stripAnsiCodes)
+	assert.Equal(t, timestampPolicy{action: timestampReroute, group: "{group}/late"}, o.sink.timestamps)
+	assert.Equal(t, int64(1048576), o.maxBodySize)
+	assert.Equal(t, 500, o.maxFrames)
+	assert.Equal(t, 1024*1024, o.maxFrameLength)
+	assert.Equal(t, "cloudwatch,s3", o.sinkNames)
+	assert.Equal(t, 500, o.queueSize)
+	assert.Equal(t, 30, o.sink.retention)
+	assert.Equal(t, oversizedTruncate, o.sink.oversized.policy("batch-1"))
+	s := o.sink.logGroups.settings("billing", o.sink.retention)
+	assert.Equal(t, 365, *s.retention)
+	assert.Equal(t, "arn:aws:kms:us-east-1:123456789012:key/abcd", s.kmsKey)
+	assert.Equal(t, map[string]string{"team": "payments"}, s.tags)
+	assert.Equal(t, "my-logs", o.sink.s3Bucket)
+	assert.Equal(t, 5*time.Minute, o.sink.s3MaxObjectAge)
+	assert.Equal(t, urlList{"https://logs.example.com/{group}"}, o.sink.relayURLs)
+}
+
+func TestParseOptionsFlagsOverrideConfig(t *testing.T) {
+	t.Setenv("DRAIN_PASS", "s3cr3t")
+	t.Setenv("METRICS_PASS", "metrics")
+	t.Setenv("QUEUE_SIZE", "500")
+	path := writeConfig(t, exampleConfig)
+	creds := writeConfig(t, `{"other": {"tokens": ["abc"]}}`)
+
+	o, err := parseOptions("drain", []string{
+		"-config", path,
+		"-bind", ":9000",
+		"-route", "app=app-logs",
+		"-retention", "7",
+		"-credentials", creds,
+	}, flag.ContinueOnError)
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", o.bind)
+	assert.Equal(t, "app=app-logs", o.routes.String())
+	assert.Equal(t, 7, o.sink.retention)
+	assert.Equal(t, "drain", o.user)
+	assert.Contains(t, o.credentials, "other")
+	assert.NotContains(t, o.credentials, "billing")
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	t.Setenv("MAX_FAILURES", "3")
+	t.Setenv("EMPTY", "")
+
+	c, err := parseConfig([]byte(`
+auth:
+  user: "${UNSET_VAR:-fallback}"
+  pass: "$${NOT_A_VAR}"
+  max_failures: ${MAX_FAILURES}
+  admin:
+    user: ${EMPTY:-admin}
+    pass: pa$$word
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", *c.Auth.User)
+	assert.Equal(t, "${NOT_A_VAR}", *c.Auth.Pass)
+	assert.Equal(t, 3, *c.Auth.MaxFailures)
+	assert.Equal(t, "admin", *c.Auth.Admin.User)
+	assert.Equal(t, "pa$word", *c.Auth.Admin.Pass)
+
+	_, err = parseConfig([]byte("auth:\n  pass: ${UNSET_VAR}\n"))
+	assert.EqualError(t, err, "line 2: environment variable UNSET_VAR is not set")
+
+	// Quoted values stay strings.
+	_, err = parseConfig([]byte("auth:\n  max_failures: \"${MAX_FAILURES}\"\n"))
+	assert.Error(t, err)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	tests := []struct {
+		config, err string
+	}{
+		{"listen:\n  https: :443\n", "line 2: unknown setting listen.https"},
+		{"auth:\n  credentials:\n    app:\n      password: x\n", "line 4: unknown setting auth.credentials.app.password"},
+		{"routes:\n  - match: x\n    to: y\n", "line 3: unknown setting routes.to"},
+		{"auth:\n  lockout: soon\n", `line 2: time: invalid duration "soon"`},
+		{"auth:\n  credentials:\n    app: {}\n", "invalid credentials for app: no user, password or tokens given"},
+		{"auth:\n  credentials_file: creds.json\n  credentials:\n    app: {user: x}\n", "only one of auth.credentials and auth.credentials_file can be set"},
+		{"sinks:\n  enabled: [cloudwatch, nope]\n", "sinks.enabled: unknown sink nope"},
+		{"sinks:\n  cloudwatch:\n    log_groups:\n      - match: x\n        retention: 45\n", "sinks.cloudwatch.log_groups[0]: invalid retention 45, must be 0 or one of 1 3 5 7 14 30 60 90 120 150 180 365 400 545 731 1096 1827 2192 2557 2922 3288 3653"},
+		{"sinks:\n  cloudwatch:\n    log_groups:\n      - match: x\n        kms: y\n", "line 5: unknown setting sinks.cloudwatch.log_groups.kms"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig([]byte(tt.config))
+		assert.EqualError(t, err, tt.err, tt.config)
+	}
+
+	_, err := parseConfig([]byte("pipeline:\n  limits:\n    max_frames: many\n"))
+	assert.Error(t, err)
+}
+
+func TestParseOptionsInvalidConfig(t *testing.T) {
+	path := writeConfig(t, "routes:\n  - match: heroku/router\n")
+	_, err := parseOptions("drain", []string{"-config", path}, flag.ContinueOnError)
+	assert.EqualError(t, err, "invalid configuration file "+path+`: routes[0]: route "heroku/router=" has no log group`)
+
+	path = writeConfig(t, "pipeline:\n  timestamps:\n    policy: drop\n")
+	_, err = parseOptions("drain", []string{"-config", path}, flag.ContinueOnError)
+	assert.Error(t, err)
+}
+
+func TestParseOptionsEmptyConfig(t *testing.T) {
+	path := writeConfig(t, "")
+	o, err := parseOptions("drain", []string{"-config", path}, flag.ContinueOnError)
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", o.bind)
+	assert.Equal(t, timestampPolicy{action: timestampClamp, group: "{group}/out-of-range"}, o.sink.timestamps)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// fileSink writes each log group to a file of its own in a directory, either
+// as NDJSON or as plain lines. Files are rotated once they reach the maximum
+// size or age, and rotated files are optionally compressed. Only the most
+// recent rotated files are kept.
+type fileSink struct {
+	dir      string
+	format   string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	compress bool
+}
+
+func newFileSink(c *sinkConfig) (sink, error) {
+	if c.fileFormat != "ndjson" && c.fileFormat != "plain" {
+		return nil, fmt.Errorf("unknown format %q, must be ndjson or plain", c.fileFormat)
+	}
+	if c.fileMaxSize <= 0 {
+		return nil, errors.New("the maximum file size must be positive")
+	}
+	if c.fileMaxAge < 0 {
+		return nil, errors.New("the maximum file age must not be negative")
+	}
+	if err := os.MkdirAll(c.fileDir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileSink{
+		dir:      c.fileDir,
+		format:   c.fileFormat,
+		maxSize:  c.fileMaxSize,
+		maxAge:   c.fileMaxAge,
+		maxFiles: c.fileMaxFiles,
+		compress: c.fileCompress,
+	}, nil
+}
+
+func (s *fileSink) logger(group string) (logger, error) {
+	ext := ".log"
+	if s.format == "ndjson" {
+		ext = ".ndjson"
+	}
+	l := &fileLogger{
+		sink:  s,
+		group: group,
+		path:  filepath.Join(s.dir, url.PathEscape(group)+ext),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// A fileLogger writes a log group to a file.
+type fileLogger struct {
+	sink  *fileSink
+	group string
+	path  string
+
+	mu     sync.Mutex
+	f      *os.File // nil if the file couldn't be opened, or once closed
+	size   int64
+	opened time.Time
+	closed bool
+	errors int64 // accessed atomically
+}
+
+func (l *fileLogger) Log(e *logparser.LogEntry) {
+	line, err := l.format(e)
+	if err != nil {
+		l.fail(err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		eventsDropped.With("file").Inc()
+		return
+	}
+	// The file may have failed to open after it was last rotated.
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			l.fail(err)
+			return
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		l.fail(err)
+		return
+	}
+	healthOf("file").succeed()
+	if l.size >= l.sink.maxSize || (l.sink.maxAge > 0 && time.Since(l.opened) >= l.sink.maxAge) {
+		if err := l.rotate(); err != nil {
+			reportFileError(fmt.Errorf("failed to rotate %s: %s", l.path, err))
+		}
+	}
+}
+
+func (l *fileLogger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+func (l *fileLogger) errorCount() int64 {
+	return atomic.LoadInt64(&l.errors)
+}
+
+func (l *fileLogger) format(e *logparser.LogEntry) ([]byte, error) {
+	if l.sink.format == "ndjson" {
+		b, err := json.Marshal(newJSONEntry(l.group, e))
+		return append(b, '\n'), err
+	}
+	return []byte(e.Time.UTC().Format(time.RFC3339Nano) + " " + e.Message + "\n"), nil
+}
+
+// fail reports an error that caused an entry to be dropped.
+func (l *fileLogger) fail(err error) {
+	eventsDropped.With("file").Inc()
+	atomic.AddInt64(&l.errors, 1)
+	healthOf("file").fail()
+	reportFileError(err)
+}
+
+func reportFileError(err error) {
+	err = fmt.Errorf("file: %s", err)
+	honeybadger.Notify(err)
+	log.Println(err)
+}
+
+// open opens the log file for appending. Must be called with l.mu held, or
+// before the logger is used.
+func (l *fileLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// rotate moves the current file aside, compresses it if enabled, removes old
+// rotated files, and opens a new file. Must be called with l.mu held.
+//
+// If the file can't be moved aside, writes continue to it and the rotation is
+// tried again on the next write. If the new file can't be opened, opening it
+// is tried again on the next write.
+func (l *fileLogger) rotate() error {
+	rotated := l.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	err := os.Rename(l.path, rotated)
+	if os.IsNotExist(err) {
+		// The file was removed from under us, so there is nothing to
+		// compress or prune.
+		l.f.Close()
+		l.f = nil
+		return l.open()
+	}
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = nil
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	if l.sink.compress {
+		if err := compressFile(rotated); err != nil {
+			return err
+		}
+	}
+	return l.prune()
+}
+
+// rotatedSuffix matches what rotate adds to the name of a file, along with the
+// extension of compressed files.
+var rotatedSuffix = regexp.MustCompile(`^\.\d{8}T\d{6}\.\d{9}(\.gz)?$`)
+
+// prune removes the oldest rotated files, keeping at most maxFiles of them.
+// Only the files rotated from this logger's file are considered, and not the
+// files of other log groups whose names start with the same name.
+func (l *fileLogger) prune() error {
+	if l.sink.maxFiles <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(l.path)
+	var matches []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, base) && rotatedSuffix.MatchString(name[len(base):]) {
+			matches = append(matches, filepath.Join(filepath.Dir(l.path), name))
+		}
+	}
+	// The timestamps in the file names sort in chronological order.
+	sort.Strings(matches)
+	for len(matches) > l.sink.maxFiles {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// compressFile replaces a file with a gzip compressed copy of it, with a .gz
+// extension.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
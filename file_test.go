@@ -0,0 +1,189 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileSink(t *testing.T, format string) (*fileSink, func()) {
+	dir, err := ioutil.TempDir("", "drain")
+	assert.NoError(t, err)
+	s, err := newFileSink(&sinkConfig{
+		fileDir:      dir,
+		fileFormat:   format,
+		fileMaxSize:  1024 * 1024,
+		fileMaxFiles: 2,
+		fileCompress: true,
+	})
+	assert.NoError(t, err)
+	return s.(*fileSink), func() { os.RemoveAll(dir) }
+}
+
+func files(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	for i, m := range matches {
+		matches[i] = filepath.Base(m)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func TestFileSinkPlain(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "plain")
+	defer cleanup()
+
+	l, err := s.logger("my-app/router")
+	assert.NoError(t, err)
+	l.Log(&logparser.LogEntry{Time: time.Date(2016, 10, 15, 8, 59, 8, 723822000, time.UTC), Message: "heroku[router]: at=info"})
+	l.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, "my-app%2Frouter.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2016-10-15T08:59:08.723822Z heroku[router]: at=info\n", string(b))
+}
+
+func TestFileSinkNDJSON(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "ndjson")
+	defer cleanup()
+
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	l.Log(&logparser.LogEntry{Time: time.Date(2016, 10, 15, 8, 59, 8, 0, time.UTC), Message: "hello", AppName: "app", ProcID: "web.1"})
+	l.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, "app.ndjson"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"time":"2016-10-15T08:59:08Z","group":"app","message":"hello","app_name":"app","proc_id":"web.1"}`+"\n", string(b))
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "plain")
+	defer cleanup()
+	s.maxSize = 10
+
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	for _, m := range []string{"first message", "second message", "third message", "fourth"} {
+		l.Log(&logparser.LogEntry{Time: time.Now(), Message: m})
+	}
+	l.Close()
+
+	names := files(t, s.dir)
+	assert.Len(t, names, 3)
+	assert.Equal(t, "app.log", names[0])
+	assert.Regexp(t, `^app\.log\.\d{8}T\d{6}\.\d{9}\.gz$`, names[1])
+
+	f, err := os.Open(filepath.Join(s.dir, names[2]))
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "fourth")
+
+	b, err = ioutil.ReadFile(filepath.Join(s.dir, "app.log"))
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+}
+
+func TestFileSinkPruneOtherGroups(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "ndjson")
+	defer cleanup()
+	s.maxSize = 10
+	s.maxFiles = 1
+	s.compress = false
+
+	// The file of log group a.ndjson.1 starts with the name of the file of
+	// log group a, and sorts before its rotated files.
+	other, err := s.logger("a.ndjson.1")
+	assert.NoError(t, err)
+	other.Log(&logparser.LogEntry{Time: time.Now(), Message: "other"})
+	other.Close()
+
+	l, err := s.logger("a")
+	assert.NoError(t, err)
+	for _, m := range []string{"first", "second", "third"} {
+		l.Log(&logparser.LogEntry{Time: time.Now(), Message: m})
+	}
+	l.Close()
+
+	names := files(t, s.dir)
+	assert.Contains(t, names, "a.ndjson.1.ndjson")
+	assert.Contains(t, names, "a.ndjson")
+	assert.Len(t, names, 4)
+}
+
+func TestFileSinkRotationByAge(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "plain")
+	defer cleanup()
+	s.maxAge = time.Millisecond
+	s.compress = false
+
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	l.Close()
+
+	names := files(t, s.dir)
+	assert.Len(t, names, 2)
+	assert.Regexp(t, `^app\.log\.\d{8}T\d{6}\.\d{9}$`, names[1])
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	s, cleanup := newTestFileSink(t, "plain")
+	defer cleanup()
+	s.maxSize = 10
+	s.compress = false
+
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+
+	// The file is removed, so rotating it opens a new one.
+	assert.NoError(t, os.Remove(filepath.Join(s.dir, "app.log")))
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "removed"})
+	assert.Equal(t, []string{"app.log"}, files(t, s.dir))
+
+	// The new file failed to open after the last rotation.
+	l.(*fileLogger).f.Close()
+	l.(*fileLogger).f = nil
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "reopened"})
+	l.Close()
+
+	names := files(t, s.dir)
+	assert.Len(t, names, 2)
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, names[1]))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "reopened")
+
+	dropped := eventsDropped.With("file").Value()
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "closed"})
+	assert.Equal(t, dropped+1, eventsDropped.With("file").Value())
+}
+
+func TestFileSinkInvalidFormat(t *testing.T) {
+	_, err := newFileSink(&sinkConfig{fileFormat: "xml"})
+	assert.Error(t, err)
+}
+
+func TestFileSinkInvalidLimits(t *testing.T) {
+	for _, c := range []sinkConfig{
+		{fileFormat: "plain", fileMaxSize: 0},
+		{fileFormat: "plain", fileMaxSize: -1},
+		{fileFormat: "plain", fileMaxSize: 1024, fileMaxAge: -time.Hour},
+	} {
+		_, err := newFileSink(&c)
+		assert.Error(t, err, "%+v", c)
+	}
+}
@@ -8,7 +8,9 @@ require (
 	github.com/jcxplorer/cwlogger v0.0.0-20170704082755-4e30a5a47e6a
 	github.com/newrelic/go-agent v1.9.0
 	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.5.0
 	gopkg.in/tylerb/graceful.v1 v1.2.15
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,5 +23,4 @@ require (
 	github.com/stretchr/objx v0.5.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
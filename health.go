@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Paths of the health checks.
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+const (
+	// healthWindow is how long a sink that failed to write, and hasn't
+	// written anything since, is reported as failing.
+	healthWindow = 5 * time.Minute
+
+	// queueSaturation is the fraction of a queue that can be in use before
+	// the sink is reported as saturated.
+	queueSaturation = 0.9
+
+	// credentialsCheckInterval is how long the result of checking the AWS
+	// credentials is reused for.
+	credentialsCheckInterval = time.Minute
+)
+
+// A sinkHealth keeps track of the recent successes and failures of a sink in
+// writing to its destination. It is safe for concurrent use.
+type sinkHealth struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+var sinkHealths = struct {
+	sync.Mutex
+	m map[string]*sinkHealth
+}{m: make(map[string]*sinkHealth)}
+
+// healthOf returns the health of the sink with the given name.
+func healthOf(sink string) *sinkHealth {
+	sinkHealths.Lock()
+	defer sinkHealths.Unlock()
+	h, ok := sinkHealths.m[sink]
+	if !ok {
+		h = new(sinkHealth)
+		sinkHealths.m[sink] = h
+	}
+	return h
+}
+
+// succeed records a successful write.
+func (h *sinkHealth) succeed() {
+	h.mu.Lock()
+	h.lastSuccess = time.Now()
+	h.mu.Unlock()
+}
+
+// fail records a failed write. The error itself is left to the sink to log.
+func (h *sinkHealth) fail() {
+	h.mu.Lock()
+	h.lastFailure = time.Now()
+	h.mu.Unlock()
+}
+
+// failing reports whether the sink failed to write within the health window
+// and hasn't written anything since.
+func (h *sinkHealth) failing(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastFailure.After(h.lastSuccess) && now.Sub(h.lastFailure) < healthWindow
+}
+
+// A credentialsCheck checks that credentials are valid, and caches the result
+// for a while so that health checks don't hit the credentials provider every
+// time. It is safe for concurrent use.
+type credentialsCheck struct {
+	check func() error
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// newAWSCredentialsCheck returns a check of the AWS credentials in the
+// environment, which calls STS GetCallerIdentity.
+func newAWSCredentialsCheck() (*credentialsCheck, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	client := sts.New(sess)
+	return &credentialsCheck{check: func() error {
+		_, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		return err
+	}}, nil
+}
+
+// result returns the error of the latest check, checking again if it is out
+// of date. Failed checks are logged, since the error isn't given in responses.
+func (c *credentialsCheck) result(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.checked) >= credentialsCheckInterval {
+		c.err = c.check()
+		c.checked = now
+		if c.err != nil {
+			log.Printf("credentials check failed: %s\n", c.err)
+		}
+	}
+	return c.err
+}
+
+// usesAWS reports whether any of the sinks writes to AWS.
+func usesAWS(sinks []namedSink) bool {
+	for _, s := range sinks {
+		switch s.name {
+		case "cloudwatch", "s3", "kinesis", "firehose":
+			return true
+		}
+	}
+	return false
+}
+
+// A readiness is the JSON body of a readiness check response.
+type readiness struct {
+	Status      string           `json:"status"`
+	Credentials *componentStatus `json:"credentials,omitempty"`
+	Sinks       []sinkReadiness  `json:"sinks"`
+}
+
+type componentStatus struct {
+	Status string `json:"status"`
+}
+
+type sinkReadiness struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+
+	// Queued is the number of entries waiting in all the queues of the sink,
+	// and FullestQueue the fraction of the fullest one in use.
+	Queued       int     `json:"queued"`
+	FullestQueue float64 `json:"fullest_queue"`
+}
+
+// Statuses in health check responses.
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusFailing     = "failing"
+	statusSaturated   = "saturated"
+	statusInvalid     = "invalid"
+)
+
+// serveLiveness responds that the drain is alive, as long as it can serve
+// requests at all.
+func (app *App) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": statusOK})
+}
+
+// serveReadiness responds with the health of the sinks and the credentials,
+// and 503 Service Unavailable if any of them isn't ok. The endpoint doesn't
+// require authentication, so it only gives statuses and never error messages,
+// which may include account IDs and resource names.
+func (app *App) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	res := app.readiness(time.Now())
+	status := http.StatusOK
+	if res.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, res)
+}
+
+func (app *App) readiness(now time.Time) *readiness {
+	res := &readiness{Status: statusOK, Sinks: []sinkReadiness{}}
+
+	s := app.settings()
+	if s.credentialsCheck != nil {
+		res.Credentials = &componentStatus{Status: statusOK}
+		if err := s.credentialsCheck.result(now); err != nil {
+			res.Credentials = &componentStatus{Status: statusInvalid}
+			res.Status = statusUnavailable
+		}
+	}
+
+	queued, fullest := app.queueUsage()
+	for _, sink := range s.sinks {
+		h := healthOf(sink.name)
+		sr := sinkReadiness{
+			Name:         sink.name,
+			Status:       statusOK,
+			Queued:       queued[sink.name],
+			FullestQueue: fullest[sink.name],
+		}
+		h.mu.Lock()
+		if !h.lastSuccess.IsZero() {
+			t := h.lastSuccess
+			sr.LastSuccess = &t
+		}
+		if !h.lastFailure.IsZero() {
+			t := h.lastFailure
+			sr.LastFailure = &t
+		}
+		h.mu.Unlock()
+
+		if h.failing(now) {
+			sr.Status = statusFailing
+		} else if sr.FullestQueue >= queueSaturation {
+			sr.Status = statusSaturated
+		}
+		if sr.Status != statusOK {
+			res.Status = statusUnavailable
+		}
+		res.Sinks = append(res.Sinks, sr)
+	}
+	sort.Slice(res.Sinks, func(i, j int) bool { return res.Sinks[i].Name < res.Sinks[j].Name })
+	return res
+}
+
+// queueUsage returns the number of entries in the queues of each sink, and
+// the fraction of the fullest queue in use.
+func (app *App) queueUsage() (queued map[string]int, fullest map[string]float64) {
+	queued = make(map[string]int)
+	fullest = make(map[string]float64)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	for _, l := range app.loggers {
+		f, ok := l.(fanoutLogger)
+		if !ok {
+			continue
+		}
+		for _, l := range f {
+			q, ok := l.(*queuedLogger)
+			if !ok {
+				continue
+			}
+			n := len(q.queue)
+			queued[q.sink] += n
+			if c := cap(q.queue); c > 0 && float64(n)/float64(c) > fullest[q.sink] {
+				fullest[q.sink] = float64(n) / float64(c)
+			}
+		}
+	}
+	return queued, fullest
+}
+
+func writeHealth(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveness(t *testing.T) {
+	app := &App{}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	app := withSettings(&App{
+		loggers: make(map[string]logger),
+	}, &settings{
+		sinks: []namedSink{{"health-ok", &testSink{l: &ChannelLogger{}}}},
+	})
+	healthOf("health-ok").succeed()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var res readiness
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, statusOK, res.Status)
+	assert.Nil(t, res.Credentials)
+	assert.Len(t, res.Sinks, 1)
+	assert.Equal(t, "health-ok", res.Sinks[0].Name)
+	assert.Equal(t, statusOK, res.Sinks[0].Status)
+	assert.NotNil(t, res.Sinks[0].LastSuccess)
+	assert.Nil(t, res.Sinks[0].LastFailure)
+}
+
+func TestReadinessFailingSink(t *testing.T) {
+	app := withSettings(&App{
+		loggers: make(map[string]logger),
+	}, &settings{
+		sinks: []namedSink{{"health-failing", &testSink{l: &ChannelLogger{}}}},
+	})
+	h := healthOf("health-failing")
+	h.succeed()
+	h.fail()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var res readiness
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, statusUnavailable, res.Status)
+	assert.Equal(t, statusFailing, res.Sinks[0].Status)
+	assert.NotContains(t, w.Body.String(), "error")
+
+	// A later success, or the failure growing old, makes the sink ok again.
+	assert.False(t, h.failing(time.Now().Add(healthWindow)))
+	h.succeed()
+	assert.False(t, h.failing(time.Now()))
+}
+
+func TestReadinessSaturatedQueue(t *testing.T) {
+	blocked := &BlockingLogger{started: make(chan bool), release: make(chan bool)}
+	q := newQueuedLogger("health-saturated", blocked, 2)
+	app := withSettings(&App{
+		loggers: map[string]logger{"app": fanoutLogger{q}},
+	}, &settings{
+		sinks: []namedSink{{"health-saturated", &testSink{}}},
+	})
+
+	q.Log(&logparser.LogEntry{Message: "1"})
+	<-blocked.started
+	q.Log(&logparser.LogEntry{Message: "2"})
+	q.Log(&logparser.LogEntry{Message: "3"})
+
+	res := app.readiness(time.Now())
+	assert.Equal(t, statusUnavailable, res.Status)
+	assert.Equal(t, statusSaturated, res.Sinks[0].Status)
+	assert.Equal(t, 2, res.Sinks[0].Queued)
+	assert.Equal(t, 1.0, res.Sinks[0].FullestQueue)
+
+	close(blocked.release)
+	go func() {
+		for range blocked.started {
+		}
+	}()
+	q.Close()
+	res = app.readiness(time.Now())
+	assert.Equal(t, statusOK, res.Status)
+}
+
+func TestReadinessCredentials(t *testing.T) {
+	checks := 0
+	var checkErr error
+	app := withSettings(&App{
+		loggers: make(map[string]logger),
+	}, &settings{
+		credentialsCheck: &credentialsCheck{check: func() error {
+			checks++
+			return checkErr
+		}},
+	})
+
+	now := time.Now()
+	res := app.readiness(now)
+	assert.Equal(t, statusOK, res.Status)
+	assert.Equal(t, &componentStatus{Status: statusOK}, res.Credentials)
+
+	// The result is cached for a while.
+	checkErr = errors.New("ExpiredToken: the security token included in the request is expired")
+	res = app.readiness(now.Add(time.Second))
+	assert.Equal(t, statusOK, res.Status)
+	assert.Equal(t, 1, checks)
+
+	res = app.readiness(now.Add(credentialsCheckInterval))
+	assert.Equal(t, statusUnavailable, res.Status)
+	assert.Equal(t, &componentStatus{Status: statusInvalid}, res.Credentials)
+	assert.Equal(t, 2, checks)
+}
+
+func TestUsesAWS(t *testing.T) {
+	assert.True(t, usesAWS([]namedSink{{name: "stdout"}, {name: "s3"}}))
+	assert.False(t, usesAWS([]namedSink{{name: "file"}, {name: "relay"}}))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// Limits of the PutRecords and PutRecordBatch APIs.
+const (
+	kinesisMaxRecords      = 500
+	kinesisMaxBatchBytes   = 5 * 1024 * 1024
+	kinesisMaxRecordBytes  = 1024 * 1024
+	firehoseMaxBatchBytes  = 4 * 1024 * 1024
+	firehoseMaxRecordBytes = 1000 * 1024
+	kinesisMaxPartitionKey = 256
+)
+
+// kinesisMaxAttempts is the number of times records are sent before they are
+// dropped.
+const kinesisMaxAttempts = 5
+
+// kinesisSink writes entries as JSON records to a Kinesis data stream, or to a
+// Kinesis Data Firehose delivery stream. Records are partitioned by log group,
+// app and dyno.
+type kinesisSink struct {
+	name     string
+	client   *awsClient
+	stream   string
+	firehose bool
+	interval time.Duration
+}
+
+func newKinesisSink(c *sinkConfig) (sink, error) {
+	if c.kinesisStream == "" {
+		return nil, errors.New("no stream given")
+	}
+	return newKinesisSinkForService("kinesis", c.kinesisStream, c.kinesisEndpoint, c.kinesisFlushInterval)
+}
+
+func newFirehoseSink(c *sinkConfig) (sink, error) {
+	if c.firehoseStream == "" {
+		return nil, errors.New("no delivery stream given")
+	}
+	return newKinesisSinkForService("firehose", c.firehoseStream, c.firehoseEndpoint, c.kinesisFlushInterval)
+}
+
+func newKinesisSinkForService(service, stream, endpoint string, interval time.Duration) (sink, error) {
+	if interval <= 0 {
+		return nil, errors.New("the flush interval must be positive")
+	}
+	region, creds, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAWSClient(service, region, endpoint, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &kinesisSink{
+		name:     service,
+		client:   client,
+		stream:   stream,
+		firehose: service == "firehose",
+		interval: interval,
+	}, nil
+}
+
+func (s *kinesisSink) logger(group string) (logger, error) {
+	maxBytes := kinesisMaxBatchBytes
+	if s.firehose {
+		maxBytes = firehoseMaxBatchBytes
+	}
+	encode := func(e *logparser.LogEntry) (batchItem, error) {
+		return s.encode(group, e)
+	}
+	return newBatchLogger(s.name, kinesisMaxRecords, maxBytes, s.interval, encode, s.put), nil
+}
+
+func (s *kinesisSink) encode(group string, e *logparser.LogEntry) (batchItem, error) {
+	data, err := json.Marshal(newJSONEntry(group, e))
+	if err != nil {
+		return batchItem{}, err
+	}
+
+	if s.firehose {
+		// Firehose concatenates records when delivering them, so they need
+		// to be separated.
+		data = append(data, '\n')
+		if len(data) > firehoseMaxRecordBytes {
+			return batchItem{}, fmt.Errorf("firehose: record of %d bytes is too large", len(data))
+		}
+		return batchItem{data: data}, nil
+	}
+
+	if len(data) > kinesisMaxRecordBytes {
+		return batchItem{}, fmt.Errorf("kinesis: record of %d bytes is too large", len(data))
+	}
+	key := group + "/" + e.AppName + "/" + e.ProcID
+	if len(key) > kinesisMaxPartitionKey {
+		key = key[:kinesisMaxPartitionKey]
+	}
+	return batchItem{data: data, key: key}, nil
+}
+
+// put writes the records, retrying the ones that fail.
+func (s *kinesisSink) put(items []batchItem) {
+	wait := retryBackoff
+	var err error
+	for attempt := 0; attempt < kinesisMaxAttempts && len(items) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		var failed []batchItem
+		failed, err = s.putRecords(items)
+		if err != nil {
+			if e, ok := err.(*awsError); ok && e.Throttled() {
+				sinkThrottled.With(s.name).Add(int64(len(items)))
+			} else if ok && !e.Temporary() {
+				break
+			}
+			continue
+		}
+		items = failed
+	}
+
+	if len(items) > 0 {
+		if err == nil {
+			err = errors.New("records failed after retries")
+		}
+		eventsDropped.With(s.name).Add(int64(len(items)))
+		err = fmt.Errorf("%s: failed to put %d records to %s: %s", s.name, len(items), s.stream, err)
+		healthOf(s.name).fail()
+		honeybadger.Notify(err)
+		log.Println(err)
+		return
+	}
+	healthOf(s.name).succeed()
+}
+
+type kinesisRecord struct {
+	Data         []byte
+	PartitionKey string `json:",omitempty"`
+}
+
+type kinesisRecordResult struct {
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// putRecords sends a single PutRecords or PutRecordBatch request, and returns
+// the records that failed.
+func (s *kinesisSink) putRecords(items []batchItem) ([]batchItem, error) {
+	records := make([]kinesisRecord, len(items))
+	for i, item := range items {
+		records[i] = kinesisRecord{Data: item.data, PartitionKey: item.key}
+	}
+
+	var target string
+	var input interface{}
+	if s.firehose {
+		target = "Firehose_20150804.PutRecordBatch"
+		input = struct {
+			DeliveryStreamName string
+			Records            []kinesisRecord
+		}{s.stream, records}
+	} else {
+		target = "Kinesis_20131202.PutRecords"
+		input = struct {
+			StreamName string
+			Records    []kinesisRecord
+		}{s.stream, records}
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{
+		"Content-Type": {"application/x-amz-json-1.1"},
+		"X-Amz-Target": {target},
+	}
+	b, _, err := s.client.do(http.MethodPost, "/", nil, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var output struct {
+		Records          []kinesisRecordResult // PutRecords
+		RequestResponses []kinesisRecordResult // PutRecordBatch
+	}
+	if err := json.Unmarshal(b, &output); err != nil {
+		return nil, err
+	}
+	results := output.Records
+	if s.firehose {
+		results = output.RequestResponses
+	}
+	if len(results) != len(items) {
+		return nil, fmt.Errorf("got %d results for %d records", len(results), len(items))
+	}
+
+	var failed []batchItem
+	for i, r := range results {
+		if r.ErrorCode == "" {
+			continue
+		}
+		if r.ErrorCode == "ProvisionedThroughputExceededException" || r.ErrorCode == "ServiceUnavailableException" {
+			sinkThrottled.With(s.name).Inc()
+		}
+		failed = append(failed, items[i])
+	}
+	return failed, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeKinesis accepts PutRecords and PutRecordBatch requests, failing the first
+// record of every request while throttled is greater than zero.
+type FakeKinesis struct {
+	mu        sync.Mutex
+	throttled int
+	targets   []string
+	records   []kinesisRecord
+}
+
+func (k *FakeKinesis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var input struct {
+		StreamName         string
+		DeliveryStreamName string
+		Records            []kinesisRecord
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+	if input.StreamName != "logs" && input.DeliveryStreamName != "logs" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ResourceNotFoundException","message":"Stream logs not found"}`)
+		return
+	}
+	k.targets = append(k.targets, r.Header.Get("X-Amz-Target"))
+
+	results := make([]kinesisRecordResult, len(input.Records))
+	for i, record := range input.Records {
+		if i == 0 && k.throttled > 0 {
+			k.throttled--
+			results[i].ErrorCode = "ProvisionedThroughputExceededException"
+			continue
+		}
+		k.records = append(k.records, record)
+	}
+	if input.DeliveryStreamName != "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"RequestResponses": results})
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"Records": results})
+	}
+}
+
+func newTestKinesisSink(t *testing.T, service, endpoint string) *kinesisSink {
+	client, err := newAWSClient(service, "us-east-1", endpoint, credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	assert.NoError(t, err)
+	return &kinesisSink{
+		name:     service,
+		client:   client,
+		stream:   "logs",
+		firehose: service == "firehose",
+		interval: time.Hour,
+	}
+}
+
+func TestKinesisSink(t *testing.T) {
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = 500 * time.Millisecond }()
+
+	fake := &FakeKinesis{throttled: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestKinesisSink(t, "kinesis", server.URL)
+	l, err := s.logger("my-app")
+	assert.NoError(t, err)
+
+	before := sinkThrottled.With("kinesis").Value()
+	for i := 0; i < 3; i++ {
+		l.Log(&logparser.LogEntry{Time: time.Now(), Message: fmt.Sprint(i), AppName: "app", ProcID: "web.1"})
+	}
+	l.Close()
+
+	assert.Equal(t, []string{"Kinesis_20131202.PutRecords", "Kinesis_20131202.PutRecords", "Kinesis_20131202.PutRecords"}, fake.targets)
+	assert.Len(t, fake.records, 3)
+	assert.Equal(t, before+2, sinkThrottled.With("kinesis").Value())
+	assert.Equal(t, "my-app/app/web.1", fake.records[0].PartitionKey)
+
+	var entry jsonEntry
+	assert.NoError(t, json.Unmarshal(fake.records[0].Data, &entry))
+	assert.Equal(t, "1", entry.Message)
+}
+
+func TestFirehoseSink(t *testing.T) {
+	fake := &FakeKinesis{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := newTestKinesisSink(t, "firehose", server.URL).logger("my-app")
+	assert.NoError(t, err)
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	l.Close()
+
+	assert.Equal(t, []string{"Firehose_20150804.PutRecordBatch"}, fake.targets)
+	assert.Len(t, fake.records, 1)
+	assert.Equal(t, byte('\n'), fake.records[0].Data[len(fake.records[0].Data)-1])
+	assert.Empty(t, fake.records[0].PartitionKey)
+}
+
+func TestKinesisSinkInvalidFlushInterval(t *testing.T) {
+	_, err := newKinesisSink(&sinkConfig{kinesisStream: "logs"})
+	assert.Error(t, err)
+	_, err = newFirehoseSink(&sinkConfig{firehoseStream: "logs", kinesisFlushInterval: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestKinesisSinkPermanentError(t *testing.T) {
+	fake := &FakeKinesis{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestKinesisSink(t, "kinesis", server.URL)
+	s.stream = "missing"
+	l, err := s.logger("my-app")
+	assert.NoError(t, err)
+
+	before := eventsDropped.With("kinesis").Value()
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	l.Close()
+
+	assert.Empty(t, fake.targets)
+	assert.Equal(t, before+1, eventsDropped.With("kinesis").Value())
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+var logGroupChanges = metrics.NewCounterVec(
+	"drain_cloudwatch_log_group_changes_total",
+	"Changes made to the retention, KMS key and tags of CloudWatch Logs log groups.",
+	"setting",
+)
+
+// retentionDays are the retention periods CloudWatch Logs accepts, in days.
+var retentionDays = []int{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// A logGroupRule sets the retention, KMS key and tags of the CloudWatch Logs
+// log groups whose names match a shell pattern.
+type logGroupRule struct {
+	pattern string
+	logGroupSettings
+}
+
+// logGroupSettings are the settings a log group should have. Settings that
+// aren't given are left as they are.
+type logGroupSettings struct {
+	// retention is the retention in days, where 0 means that events never
+	// expire.
+	retention *int
+
+	// kmsKey is the ARN of the KMS key to encrypt the log group with.
+	kmsKey string
+
+	tags map[string]string
+}
+
+func (s logGroupSettings) empty() bool {
+	return s.retention == nil && s.kmsKey == "" && len(s.tags) == 0
+}
+
+// validate checks the rule against the limits of CloudWatch Logs.
+func (r logGroupRule) validate() error {
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", r.pattern, err)
+	}
+	if r.retention != nil && *r.retention != 0 && !validRetention(*r.retention) {
+		return fmt.Errorf("invalid retention %d, must be 0 or one of %s", *r.retention, strings.Trim(fmt.Sprint(retentionDays), "[]"))
+	}
+	if r.kmsKey != "" && !strings.HasPrefix(r.kmsKey, "arn:") {
+		return fmt.Errorf("kms_key %q must be the ARN of a KMS key", r.kmsKey)
+	}
+	if len(r.tags) > 50 {
+		return errors.New("a log group can have at most 50 tags")
+	}
+	for k := range r.tags {
+		if k == "" {
+			return errors.New("tag keys must not be empty")
+		}
+	}
+	return nil
+}
+
+func validRetention(days int) bool {
+	for _, d := range retentionDays {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// logGroupRules is an ordered list of rules, where the first matching rule
+// wins.
+type logGroupRules []logGroupRule
+
+// settings returns the settings for a log group, which are those of the first
+// matching rule. The retention is the default one, unless the rule sets one or
+// the default is zero.
+func (rs logGroupRules) settings(group string, retention int) logGroupSettings {
+	var s logGroupSettings
+	for _, r := range rs {
+		if matchPattern(r.pattern, group) {
+			s = r.logGroupSettings
+			break
+		}
+	}
+	if s.retention == nil && retention != 0 {
+		s.retention = &retention
+	}
+	return s
+}
+
+// reconcileLogGroup changes the settings of an existing log group that differ
+// from the given ones. Tags that aren't given are left as they are, and so is
+// the KMS key if none is given.
+func reconcileLogGroup(client *cloudwatchlogs.CloudWatchLogs, group string, s logGroupSettings) error {
+	if s.empty() {
+		return nil
+	}
+	out, err := client.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(group),
+		Limit:              aws.Int64(1),
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.LogGroups) == 0 || aws.StringValue(out.LogGroups[0].LogGroupName) != group {
+		return fmt.Errorf("log group %s not found", group)
+	}
+	current := out.LogGroups[0]
+
+	if s.retention != nil && int64(*s.retention) != aws.Int64Value(current.RetentionInDays) {
+		if *s.retention == 0 {
+			_, err = client.DeleteRetentionPolicy(&cloudwatchlogs.DeleteRetentionPolicyInput{
+				LogGroupName: aws.String(group),
+			})
+		} else {
+			_, err = client.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+				LogGroupName:    aws.String(group),
+				RetentionInDays: aws.Int64(int64(*s.retention)),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set the retention of log group %s: %s", group, err)
+		}
+		logGroupChanges.With("retention").Inc()
+	}
+
+	if s.kmsKey != "" && s.kmsKey != aws.StringValue(current.KmsKeyId) {
+		_, err = client.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+			LogGroupName: aws.String(group),
+			KmsKeyId:     aws.String(s.kmsKey),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set the KMS key of log group %s: %s", group, err)
+		}
+		logGroupChanges.With("kms_key").Inc()
+	}
+
+	if len(s.tags) > 0 {
+		tags, err := client.ListTagsLogGroup(&cloudwatchlogs.ListTagsLogGroupInput{
+			LogGroupName: aws.String(group),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list the tags of log group %s: %s", group, err)
+		}
+		changed := make(map[string]*string)
+		for k, v := range s.tags {
+			if old, ok := tags.Tags[k]; !ok || aws.StringValue(old) != v {
+				changed[k] = aws.String(v)
+			}
+		}
+		if len(changed) > 0 {
+			_, err = client.TagLogGroup(&cloudwatchlogs.TagLogGroupInput{
+				LogGroupName: aws.String(group),
+				Tags:         changed,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to tag log group %s: %s", group, err)
+			}
+			logGroupChanges.With("tags").Inc()
+		}
+	}
+	return nil
+}
+
+// setLogGroups replaces the settings of log groups in the sinks that keep
+// settings for them with those of the configuration.
+func setLogGroups(sinks []namedSink, c *sinkConfig) {
+	for _, s := range sinks {
+		if r, ok := s.sink.(reconciler); ok {
+			r.setLogGroups(c.retention, c.logGroups)
+		}
+	}
+}
+
+// reconcileLogGroups brings the settings of the log groups in line with the
+// configuration of the sinks that keep settings for them.
+func reconcileLogGroups(sinks []namedSink, groups []string) {
+	for _, s := range sinks {
+		r, ok := s.sink.(reconciler)
+		if !ok {
+			continue
+		}
+		for _, group := range groups {
+			if err := r.reconcile(group); err != nil {
+				err = fmt.Errorf("%s: %s", s.name, err)
+				honeybadger.Notify(err)
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLogGroup struct {
+	retention int
+	kmsKey    string
+	tags      map[string]string
+}
+
+// FakeCloudWatchLogs implements the CloudWatch Logs operations used to manage
+// the settings of log groups and to write to them, and records the operations
+// called.
+type FakeCloudWatchLogs struct {
+	mu         sync.Mutex
+	groups     map[string]*fakeLogGroup
+	operations []string
+
+	// putErrors are the error codes the next PutLogEvents requests fail
+	// with, events the number of events written, and messages the messages
+	// written to each log group.
+	putErrors []string
+	events    int
+	messages  map[string][]string
+}
+
+func (f *FakeCloudWatchLogs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+	f.operations = append(f.operations, op)
+	var input struct {
+		LogGroupName       string
+		LogGroupNamePrefix string
+		RetentionInDays    int
+		KmsKeyId           string
+		Tags               map[string]string
+		LogEvents          []struct{ Message string }
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+
+	if op == "CreateLogGroup" {
+		if _, ok := f.groups[input.LogGroupName]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ResourceAlreadyExistsException","message":"The specified log group already exists"}`)
+			return
+		}
+		f.groups[input.LogGroupName] = &fakeLogGroup{tags: map[string]string{}}
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	if op == "DescribeLogGroups" {
+		groups := []map[string]interface{}{}
+		if g, ok := f.groups[input.LogGroupNamePrefix]; ok {
+			group := map[string]interface{}{"logGroupName": input.LogGroupNamePrefix}
+			if g.retention != 0 {
+				group["retentionInDays"] = g.retention
+			}
+			if g.kmsKey != "" {
+				group["kmsKeyId"] = g.kmsKey
+			}
+			groups = append(groups, group)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"logGroups": groups})
+		return
+	}
+
+	g, ok := f.groups[input.LogGroupName]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ResourceNotFoundException","message":"The specified log group does not exist."}`)
+		return
+	}
+	switch op {
+	case "PutRetentionPolicy":
+		g.retention = input.RetentionInDays
+	case "DeleteRetentionPolicy":
+		g.retention = 0
+	case "AssociateKmsKey":
+		g.kmsKey = input.KmsKeyId
+	case "ListTagsLogGroup":
+		json.NewEncoder(w).Encode(map[string]interface{}{"tags": g.tags})
+		return
+	case "TagLogGroup":
+		for k, v := range input.Tags {
+			g.tags[k] = v
+		}
+	case "PutLogEvents":
+		if len(f.putErrors) > 0 {
+			code := f.putErrors[0]
+			f.putErrors = f.putErrors[1:]
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":%q,"message":"failed"}`, code)
+			return
+		}
+		f.events += len(input.LogEvents)
+		if f.messages == nil {
+			f.messages = make(map[string][]string)
+		}
+		for _, e := range input.LogEvents {
+			f.messages[input.LogGroupName] = append(f.messages[input.LogGroupName], e.Message)
+		}
+		fmt.Fprint(w, `{"nextSequenceToken":"1"}`)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func (f *FakeCloudWatchLogs) Operations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops := f.operations
+	f.operations = nil
+	return ops
+}
+
+func newTestCloudWatchClient(endpoint string) *cloudwatchlogs.CloudWatchLogs {
+	return cloudwatchlogs.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+}
+
+func TestReconcileLogGroup(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{
+		"billing": {retention: 7, tags: map[string]string{"team": "ops", "cost-center": "42"}},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newTestCloudWatchClient(server.URL)
+
+	retention := 30
+	s := logGroupSettings{
+		retention: &retention,
+		kmsKey:    "arn:aws:kms:us-east-1:123456789012:key/abcd",
+		tags:      map[string]string{"team": "payments"},
+	}
+	assert.NoError(t, reconcileLogGroup(client, "billing", s))
+	assert.Equal(t, []string{"DescribeLogGroups", "PutRetentionPolicy", "AssociateKmsKey", "ListTagsLogGroup", "TagLogGroup"}, fake.Operations())
+	assert.Equal(t, &fakeLogGroup{
+		retention: 30,
+		kmsKey:    "arn:aws:kms:us-east-1:123456789012:key/abcd",
+		tags:      map[string]string{"team": "payments", "cost-center": "42"},
+	}, fake.groups["billing"])
+
+	// Nothing changes when the log group is up to date.
+	assert.NoError(t, reconcileLogGroup(client, "billing", s))
+	assert.Equal(t, []string{"DescribeLogGroups", "ListTagsLogGroup"}, fake.Operations())
+
+	never := 0
+	assert.NoError(t, reconcileLogGroup(client, "billing", logGroupSettings{retention: &never}))
+	assert.Equal(t, []string{"DescribeLogGroups", "DeleteRetentionPolicy"}, fake.Operations())
+	assert.Equal(t, 0, fake.groups["billing"].retention)
+
+	assert.NoError(t, reconcileLogGroup(client, "billing", logGroupSettings{}))
+	assert.Empty(t, fake.Operations())
+
+	assert.EqualError(t, reconcileLogGroup(client, "missing", s), "log group missing not found")
+}
+
+func TestCloudWatchSinkReconcile(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{"billing": {retention: 7}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := &cloudWatchSink{
+		client:    newTestCloudWatchClient(server.URL),
+		retention: 30,
+		applied:   make(map[string]logGroupSettings),
+	}
+
+	assert.NoError(t, s.reconcile("billing"))
+	assert.Equal(t, []string{"DescribeLogGroups", "PutRetentionPolicy"}, fake.Operations())
+	assert.Equal(t, 30, fake.groups["billing"].retention)
+
+	// Settings that have been applied aren't looked up again.
+	assert.NoError(t, s.reconcile("billing"))
+	assert.Empty(t, fake.Operations())
+
+	s.setLogGroups(14, nil)
+	assert.NoError(t, s.reconcile("billing"))
+	assert.Equal(t, []string{"DescribeLogGroups", "PutRetentionPolicy"}, fake.Operations())
+	assert.Equal(t, 14, fake.groups["billing"].retention)
+
+	// Failures are tried again.
+	assert.Error(t, s.reconcile("missing"))
+	assert.Error(t, s.reconcile("missing"))
+	assert.Equal(t, []string{"DescribeLogGroups", "DescribeLogGroups"}, fake.Operations())
+}
+
+func TestLogGroupRulesSettings(t *testing.T) {
+	days := 365
+	rules := logGroupRules{
+		{pattern: "prod-*", logGroupSettings: logGroupSettings{retention: &days, kmsKey: "arn:aws:kms:key"}},
+		{pattern: "*", logGroupSettings: logGroupSettings{tags: map[string]string{"team": "ops"}}},
+	}
+
+	s := rules.settings("prod-api", 30)
+	assert.Equal(t, 365, *s.retention)
+	assert.Equal(t, "arn:aws:kms:key", s.kmsKey)
+	assert.Nil(t, s.tags)
+
+	s = rules.settings("staging", 30)
+	assert.Equal(t, 30, *s.retention)
+	assert.Equal(t, map[string]string{"team": "ops"}, s.tags)
+
+	s = logGroupRules(nil).settings("staging", 0)
+	assert.True(t, s.empty())
+}
+
+func TestLogGroupRuleValidate(t *testing.T) {
+	days := func(d int) *int { return &d }
+	assert.NoError(t, logGroupRule{pattern: "prod-*", logGroupSettings: logGroupSettings{retention: days(0)}}.validate())
+	assert.NoError(t, logGroupRule{pattern: "prod-*", logGroupSettings: logGroupSettings{retention: days(3653)}}.validate())
+
+	for _, r := range []logGroupRule{
+		{pattern: "[", logGroupSettings: logGroupSettings{}},
+		{pattern: "*", logGroupSettings: logGroupSettings{retention: days(45)}},
+		{pattern: "*", logGroupSettings: logGroupSettings{kmsKey: "alias/logs"}},
+		{pattern: "*", logGroupSettings: logGroupSettings{tags: map[string]string{"": "x"}}},
+	} {
+		assert.Error(t, r.validate(), "%+v", r)
+	}
+}
+
+// ReconcilingSink records the log groups it is asked to reconcile, and the
+// settings it is given.
+type ReconcilingSink struct {
+	testSink
+	groups    []string
+	retention int
+	logGroups logGroupRules
+}
+
+func (s *ReconcilingSink) reconcile(group string) error {
+	s.groups = append(s.groups, group)
+	return nil
+}
+
+func (s *ReconcilingSink) setLogGroups(retention int, rules logGroupRules) {
+	s.retention = retention
+	s.logGroups = rules
+}
+
+func TestReconcileLogGroups(t *testing.T) {
+	r := new(ReconcilingSink)
+	sinks := []namedSink{{"plain", &testSink{}}, {"reconciling", r}}
+	reconcileLogGroups(sinks, []string{"a", "b"})
+	assert.Equal(t, []string{"a", "b"}, r.groups)
+}
+
+func TestSetLogGroups(t *testing.T) {
+	r := new(ReconcilingSink)
+	rules := logGroupRules{{pattern: "prod-*", logGroupSettings: logGroupSettings{kmsKey: "alias/logs"}}}
+	setLogGroups([]namedSink{{"plain", &testSink{}}, {"reconciling", r}}, &sinkConfig{retention: 7, logGroups: rules})
+	assert.Equal(t, 7, r.retention)
+	assert.Equal(t, rules, r.logGroups)
+}
@@ -1,6 +1,7 @@
 package logparser
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"time"
@@ -12,9 +13,28 @@ type ParseFunc func(b []byte) (*LogEntry, error)
 
 // A LogEntry represents a single log event containing the timestamp of the
 // event, and the logged message.
+//
+// Message is formatted as "APP-NAME[PROCID]: MSG". The syslog header fields it
+// was built from are also available on their own.
 type LogEntry struct {
 	Time    time.Time
 	Message string
+
+	Hostname string
+	AppName  string
+	ProcID   string
+
+	// Attributes holds any other fields of the entry, such as the attributes of
+	// OpenTelemetry log records.
+	Attributes map[string]string
+
+	// StructuredData holds the parameters of the SD-ELEMENTs of the message by
+	// SD-ID, if it had any.
+	StructuredData map[string]map[string]string
+
+	// Raw is the syslog message the entry was parsed from, without its octet
+	// count, so that it can be relayed as it was received.
+	Raw []byte
 }
 
 // Parse returns a parsed entry for a single Heroku syslog message delivered via
@@ -44,8 +64,9 @@ func (p *logParser) parse() (*LogEntry, error) {
 		return nil, fmt.Errorf("failed to parse TIMESTAMP: %s", err)
 	}
 
-	if err = p.skip(1); err != nil {
-		return nil, fmt.Errorf("failed to skip to APP-NAME: %s", err)
+	hostname, err := p.nextWord()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HOSTNAME: %s", err)
 	}
 
 	app, err := p.nextWord()
@@ -65,8 +86,12 @@ func (p *logParser) parse() (*LogEntry, error) {
 	message := app + "[" + process + "]: " + string(p.b[p.cursor:])
 
 	return &LogEntry{
-		Time:    t,
-		Message: message,
+		Time:     t,
+		Message:  message,
+		Hostname: hostname,
+		AppName:  app,
+		ProcID:   process,
+		Raw:      p.b[bytes.IndexByte(p.b, ' ')+1:],
 	}, nil
 }
 
@@ -11,6 +11,10 @@ func TestParseValidMessage(t *testing.T) {
 	entry, err := Parse([]byte(`89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down`))
 	assert.NoError(t, err)
 	assert.Equal(t, "heroku[web.1]: State changed from up to down", entry.Message)
+	assert.Equal(t, "host", entry.Hostname)
+	assert.Equal(t, "heroku", entry.AppName)
+	assert.Equal(t, "web.1", entry.ProcID)
+	assert.Equal(t, "<45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down", string(entry.Raw))
 	assert.WithinDuration(t, time.Date(2016, 10, 15, 8, 59, 8, 723822000, time.UTC), entry.Time, time.Microsecond)
 }
 
@@ -0,0 +1,141 @@
+package logparser
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// rfc3164Timestamp is the layout of RFC 3164 timestamps, which have neither a
+// year nor a time zone.
+const rfc3164Timestamp = "Jan _2 15:04:05"
+
+// maxTagLength is the maximum length of a TAG, as given in RFC 3164.
+const maxTagLength = 32
+
+// ParseRFC3164 returns a parsed entry for a single RFC 3164 (BSD syslog)
+// message, such as:
+//
+//	<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick
+//
+// Timestamps are taken to be in UTC, in the year that puts them closest to the
+// current time. Feb 29 is taken to be the current time if none of the years
+// around the current one is a leap year. Since senders are lax about the
+// format, RFC 3339 timestamps are accepted too, and the timestamp and the
+// hostname may be left out. The TAG is used as the APP-NAME, and the pid in
+// brackets after it as the PROCID.
+func ParseRFC3164(b []byte) (*LogEntry, error) {
+	b = bytes.TrimRight(b, "\r\n")
+	cursor, err := parsePriority(b)
+	if err != nil {
+		return nil, err
+	}
+	rest := b[cursor:]
+
+	t, n := parseRFC3164Timestamp(rest)
+	rest = rest[n:]
+
+	e := &LogEntry{Time: t, Raw: b}
+	if n > 0 {
+		// The hostname is only present after a timestamp, and is never a TAG.
+		if i := bytes.IndexByte(rest, ' '); i > 0 && !isTag(rest[:i]) {
+			e.Hostname = string(rest[:i])
+			rest = rest[i+1:]
+		}
+	}
+
+	var content []byte
+	e.AppName, e.ProcID, content = parseTag(rest)
+	e.Message = FormatMessage(e.AppName, e.ProcID, string(content))
+	return e, nil
+}
+
+// parseRFC3164Timestamp parses the timestamp at the start of b, and returns it
+// along with the number of bytes it took, including the space after it. If b
+// doesn't start with a timestamp, the current time is returned.
+func parseRFC3164Timestamp(b []byte) (time.Time, int) {
+	current := now().UTC()
+
+	if len(b) > len(rfc3164Timestamp) && b[len(rfc3164Timestamp)] == ' ' {
+		stamp := string(b[:len(rfc3164Timestamp)])
+		// A message from late December received in early January is from
+		// the previous year, and vice versa. The year has to be known before
+		// parsing, or Feb 29 would turn into Mar 1.
+		var t time.Time
+		for _, year := range []int{current.Year(), current.Year() - 1, current.Year() + 1} {
+			parsed, err := time.Parse("2006 "+rfc3164Timestamp, strconv.Itoa(year)+" "+stamp)
+			if err == nil && (t.IsZero() || absDuration(parsed.Sub(current)) < absDuration(t.Sub(current))) {
+				t = parsed
+			}
+		}
+		if !t.IsZero() {
+			return t, len(rfc3164Timestamp) + 1
+		}
+		// A valid timestamp that isn't in any of those years.
+		if _, err := time.Parse("2006 "+rfc3164Timestamp, "2000 "+stamp); err == nil {
+			return current, len(rfc3164Timestamp) + 1
+		}
+	}
+
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, string(b[:i])); err == nil {
+			return t, i + 1
+		}
+	}
+	return current, 0
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// parseTag splits the content of a message into the TAG, the pid given after
+// it if any, and the rest of the content. The TAG is left empty if the content
+// doesn't start with one.
+func parseTag(b []byte) (tag, pid string, content []byte) {
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		i = len(b)
+	}
+	word := b[:i]
+	if !isTag(word) {
+		return "", "", b
+	}
+	if i < len(b) {
+		i++
+	}
+	content = b[i:]
+
+	word = bytes.TrimSuffix(word, []byte(":"))
+	if j := bytes.IndexByte(word, '['); j > 0 && word[len(word)-1] == ']' {
+		return string(word[:j]), string(word[j+1 : len(word)-1]), content
+	}
+	return string(word), "", content
+}
+
+// isTag reports whether a word is a TAG, with an optional pid in brackets,
+// followed by a colon, such as "su[123]:" or "CRON:".
+func isTag(word []byte) bool {
+	if len(word) < 2 || word[len(word)-1] != ':' {
+		return false
+	}
+	word = word[:len(word)-1]
+	if j := bytes.IndexByte(word, '['); j >= 0 {
+		if word[len(word)-1] != ']' {
+			return false
+		}
+		word = word[:j]
+	}
+	if len(word) == 0 || len(word) > maxTagLength {
+		return false
+	}
+	for _, c := range word {
+		if c <= ' ' || c > '~' || c == ':' || c == '[' || c == ']' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package logparser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setNow(t time.Time) func() {
+	now = func() time.Time { return t }
+	return func() { now = time.Now }
+}
+
+func TestParseRFC3164(t *testing.T) {
+	defer setNow(time.Date(2017, 10, 15, 12, 0, 0, 0, time.UTC))()
+
+	entry, err := ParseRFC3164([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 10, 11, 22, 14, 15, 0, time.UTC), entry.Time)
+	assert.Equal(t, "mymachine", entry.Hostname)
+	assert.Equal(t, "su", entry.AppName)
+	assert.Equal(t, "123", entry.ProcID)
+	assert.Equal(t, "su[123]: 'su root' failed for lonvick on /dev/pts/8", entry.Message)
+	assert.Equal(t, "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8", string(entry.Raw))
+}
+
+func TestParseRFC3164Variants(t *testing.T) {
+	current := time.Date(2018, 1, 1, 0, 5, 0, 0, time.UTC)
+	defer setNow(current)()
+
+	tests := []struct {
+		message  string
+		time     time.Time
+		hostname string
+		appName  string
+		procID   string
+		text     string
+	}{
+		{"<13>Dec 31 23:59:59 host CRON: job done", time.Date(2017, 12, 31, 23, 59, 59, 0, time.UTC), "host", "CRON", "", "CRON: job done"},
+		{"<13>Jan  1 00:04:00 host postfix/smtpd[99]: connect", time.Date(2018, 1, 1, 0, 4, 0, 0, time.UTC), "host", "postfix/smtpd", "99", "postfix/smtpd[99]: connect"},
+		{"<13>Jan  1 00:04:00 sshd[7]: no hostname", time.Date(2018, 1, 1, 0, 4, 0, 0, time.UTC), "", "sshd", "7", "sshd[7]: no hostname"},
+		{"<13>2017-12-31T23:00:00+01:00 host app: rfc3339", time.Date(2017, 12, 31, 22, 0, 0, 0, time.UTC), "host", "app", "", "app: rfc3339"},
+		{"<13>app[1]: no timestamp", current, "", "app", "1", "app[1]: no timestamp"},
+		{"<13>just some text", current, "", "", "", "just some text"},
+		{"<13>Jan  1 00:04:00 switch link up on port 3", time.Date(2018, 1, 1, 0, 4, 0, 0, time.UTC), "switch", "", "", "link up on port 3"},
+	}
+	for _, test := range tests {
+		entry, err := ParseRFC3164([]byte(test.message))
+		assert.NoError(t, err, test.message)
+		assert.True(t, test.time.Equal(entry.Time), test.message)
+		assert.Equal(t, test.hostname, entry.Hostname, test.message)
+		assert.Equal(t, test.appName, entry.AppName, test.message)
+		assert.Equal(t, test.procID, entry.ProcID, test.message)
+		assert.Equal(t, test.text, entry.Message, test.message)
+	}
+}
+
+func TestParseRFC3164LeapDay(t *testing.T) {
+	restore := setNow(time.Date(2028, 3, 1, 0, 0, 0, 0, time.UTC))
+	entry, err := ParseRFC3164([]byte("<13>Feb 29 23:00:00 host app: leap day"))
+	restore()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2028, 2, 29, 23, 0, 0, 0, time.UTC), entry.Time)
+
+	// The closest leap year is too far from the current time.
+	current := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	defer setNow(current)()
+	entry, err = ParseRFC3164([]byte("<13>Feb 29 23:00:00 host app: leap day"))
+	assert.NoError(t, err)
+	assert.Equal(t, current, entry.Time)
+	assert.Equal(t, "host", entry.Hostname)
+	assert.Equal(t, "app: leap day", entry.Message)
+}
+
+func TestParseRFC3164InvalidMessages(t *testing.T) {
+	for _, test := range []string{``, `Oct 11 22:14:15 host su: no PRI`, `<>Oct 11 22:14:15 host su: msg`, `<999>msg`} {
+		entry, err := ParseRFC3164([]byte(test))
+		assert.Error(t, err, test)
+		assert.Nil(t, entry)
+	}
+}
+
+func TestParseSyslogDetectsFormat(t *testing.T) {
+	entry, err := ParseSyslog([]byte("<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - 'su root' failed"))
+	assert.NoError(t, err)
+	assert.Equal(t, "su: 'su root' failed", entry.Message)
+
+	entry, err = ParseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su: 'su root' failed"))
+	assert.NoError(t, err)
+	assert.Equal(t, "su: 'su root' failed", entry.Message)
+	assert.Equal(t, "mymachine", entry.Hostname)
+}
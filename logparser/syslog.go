@@ -0,0 +1,242 @@
+package logparser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// nilValue is the syslog NILVALUE, used for header fields that are not set.
+const nilValue = "-"
+
+var bom = []byte("\xef\xbb\xbf")
+
+// now returns the current time. It is replaced in tests.
+var now = time.Now
+
+// ParseSyslog returns a parsed entry for a single syslog message, without the
+// octet count or trailing newline of its transport framing. Both RFC 5424 and
+// RFC 3164 messages are accepted; messages with a VERSION after the PRI are
+// taken to be RFC 5424 messages.
+func ParseSyslog(b []byte) (*LogEntry, error) {
+	b = bytes.TrimRight(b, "\r\n")
+	if i := bytes.IndexByte(b, '>'); i > 0 && bytes.HasPrefix(b[i+1:], []byte("1 ")) {
+		return ParseRFC5424(b)
+	}
+	return ParseRFC3164(b)
+}
+
+// ParseRFC5424 returns a parsed entry for a single RFC 5424 syslog message,
+// without the octet count or trailing newline of its transport framing.
+//
+// Structured data is optional, since Heroku leaves it out altogether instead of
+// sending a NILVALUE. Header fields with the NILVALUE are left empty, and a
+// missing timestamp is replaced with the current time.
+func ParseRFC5424(b []byte) (*LogEntry, error) {
+	p := syslogParser{b: bytes.TrimRight(b, "\r\n")}
+	return p.parse()
+}
+
+type syslogParser struct {
+	b      []byte
+	cursor int
+}
+
+func (p *syslogParser) parse() (*LogEntry, error) {
+	if err := p.parsePriority(); err != nil {
+		return nil, fmt.Errorf("failed to parse PRI: %s", err)
+	}
+	if version, err := p.nextWord(); err != nil || version != "1" {
+		return nil, fmt.Errorf("unsupported VERSION %q", version)
+	}
+
+	timestamp, err := p.nextWord()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TIMESTAMP: %s", err)
+	}
+	t := now()
+	if timestamp != nilValue {
+		if t, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			return nil, fmt.Errorf("failed to parse TIMESTAMP: %s", err)
+		}
+	}
+
+	var fields [4]string
+	for i, name := range []string{"HOSTNAME", "APP-NAME", "PROCID", "MSGID"} {
+		if fields[i], err = p.nextWord(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		if fields[i] == nilValue {
+			fields[i] = ""
+		}
+	}
+
+	sd, err := p.parseStructuredData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse STRUCTURED-DATA: %s", err)
+	}
+
+	e := &LogEntry{
+		Time:           t,
+		Hostname:       fields[0],
+		AppName:        fields[1],
+		ProcID:         fields[2],
+		StructuredData: sd,
+		Raw:            p.b,
+	}
+	e.Message = FormatMessage(e.AppName, e.ProcID, string(bytes.TrimPrefix(p.b[p.cursor:], bom)))
+	return e, nil
+}
+
+// FormatMessage formats a message as "APP-NAME[PROCID]: MSG", the same way as
+// the Message of entries parsed from Heroku, leaving out the parts that are not
+// set.
+func FormatMessage(app, procID, msg string) string {
+	switch {
+	case app == "":
+		return msg
+	case procID == "":
+		return app + ": " + msg
+	default:
+		return app + "[" + procID + "]: " + msg
+	}
+}
+
+func (p *syslogParser) parsePriority() error {
+	n, err := parsePriority(p.b)
+	p.cursor = n
+	return err
+}
+
+// parsePriority parses the PRI at the start of a message, and returns its
+// length.
+func parsePriority(b []byte) (int, error) {
+	if len(b) == 0 || b[0] != '<' {
+		return 0, errors.New("expected '<'")
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return 0, errors.New("expected 1 to 3 digits followed by '>'")
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri > 191 {
+		return 0, fmt.Errorf("invalid priority %q", b[1:end])
+	}
+	return end + 1, nil
+}
+
+// nextWord returns the word at the cursor, and moves the cursor past the space
+// that follows it. The last word of the message may be followed by the end of
+// the message instead.
+func (p *syslogParser) nextWord() (string, error) {
+	if p.cursor >= len(p.b) {
+		return "", errors.New("unexpected EOF")
+	}
+	end := bytes.IndexByte(p.b[p.cursor:], ' ')
+	if end < 0 {
+		end = len(p.b) - p.cursor
+	}
+	if end == 0 {
+		return "", errors.New("unexpected space")
+	}
+	word := string(p.b[p.cursor : p.cursor+end])
+	p.cursor += end + 1
+	if p.cursor > len(p.b) {
+		p.cursor = len(p.b)
+	}
+	return word, nil
+}
+
+// parseStructuredData parses the SD-ELEMENTs at the cursor, and moves the
+// cursor to the start of MSG.
+func (p *syslogParser) parseStructuredData() (map[string]map[string]string, error) {
+	rest := p.b[p.cursor:]
+	if bytes.Equal(rest, []byte(nilValue)) || bytes.HasPrefix(rest, []byte(nilValue+" ")) {
+		p.cursor += len(nilValue) + 1
+		if p.cursor > len(p.b) {
+			p.cursor = len(p.b)
+		}
+		return nil, nil
+	}
+	if len(rest) == 0 || rest[0] != '[' {
+		// No structured data at all, as sent by Heroku.
+		return nil, nil
+	}
+
+	sd := make(map[string]map[string]string)
+	for p.cursor < len(p.b) && p.b[p.cursor] == '[' {
+		p.cursor++
+		id, err := p.parseName()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SD-ID: %s", err)
+		}
+		params := make(map[string]string)
+		for p.cursor < len(p.b) && p.b[p.cursor] == ' ' {
+			p.cursor++
+			name, err := p.parseName()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read PARAM-NAME of %s: %s", id, err)
+			}
+			if p.cursor+1 >= len(p.b) || p.b[p.cursor] != '=' || p.b[p.cursor+1] != '"' {
+				return nil, fmt.Errorf("expected '=\"' after %s", name)
+			}
+			p.cursor += 2
+			value, err := p.parseParamValue()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read PARAM-VALUE of %s: %s", name, err)
+			}
+			params[name] = value
+		}
+		if p.cursor >= len(p.b) || p.b[p.cursor] != ']' {
+			return nil, fmt.Errorf("expected ']' after %s", id)
+		}
+		p.cursor++
+		sd[id] = params
+	}
+
+	if p.cursor < len(p.b) {
+		if p.b[p.cursor] != ' ' {
+			return nil, errors.New("expected a space after the last SD-ELEMENT")
+		}
+		p.cursor++
+	}
+	return sd, nil
+}
+
+// parseName reads an SD-ID or PARAM-NAME.
+func (p *syslogParser) parseName() (string, error) {
+	start := p.cursor
+	for p.cursor < len(p.b) {
+		c := p.b[p.cursor]
+		if c == ' ' || c == '=' || c == ']' || c == '"' {
+			break
+		}
+		p.cursor++
+	}
+	if p.cursor == start || p.cursor-start > 32 {
+		return "", errors.New("name must be 1 to 32 characters")
+	}
+	return string(p.b[start:p.cursor]), nil
+}
+
+// parseParamValue reads a PARAM-VALUE up to the closing quote, and unescapes
+// it.
+func (p *syslogParser) parseParamValue() (string, error) {
+	var value []byte
+	for ; p.cursor < len(p.b); p.cursor++ {
+		c := p.b[p.cursor]
+		switch {
+		case c == '"':
+			p.cursor++
+			return string(value), nil
+		case c == '\\' && p.cursor+1 < len(p.b) && bytes.IndexByte([]byte(`"\]`), p.b[p.cursor+1]) >= 0:
+			p.cursor++
+			value = append(value, p.b[p.cursor])
+		default:
+			value = append(value, c)
+		}
+	}
+	return "", errors.New("unexpected EOF")
+}
@@ -0,0 +1,61 @@
+package logparser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslog(t *testing.T) {
+	entry, err := ParseSyslog([]byte("<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"App\\\"lication\\]\"][meta group=\"my-app\"] \xef\xbb\xbfAn application event\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "evntslog: An application event", entry.Message)
+	assert.Equal(t, "mymachine.example.com", entry.Hostname)
+	assert.Equal(t, "evntslog", entry.AppName)
+	assert.Empty(t, entry.ProcID)
+	assert.Equal(t, map[string]map[string]string{
+		"exampleSDID@32473": {"iut": "3", "eventSource": `App"lication]`},
+		"meta":              {"group": "my-app"},
+	}, entry.StructuredData)
+	assert.Equal(t, time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), entry.Time)
+	assert.Equal(t, "<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"App\\\"lication\\]\"][meta group=\"my-app\"] \xef\xbb\xbfAn application event", string(entry.Raw))
+}
+
+func TestParseSyslogNilValues(t *testing.T) {
+	entry, err := ParseSyslog([]byte("<34>1 - - su 1234 - - 'su root' failed"))
+	assert.NoError(t, err)
+	assert.Equal(t, "su[1234]: 'su root' failed", entry.Message)
+	assert.Empty(t, entry.Hostname)
+	assert.Nil(t, entry.StructuredData)
+	assert.WithinDuration(t, time.Now(), entry.Time, time.Minute)
+}
+
+func TestParseSyslogHeroku(t *testing.T) {
+	entry, err := ParseSyslog([]byte("<40>1 2012-11-30T06:45:29+00:00 host app web.3 - State changed from starting to up\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app[web.3]: State changed from starting to up", entry.Message)
+	assert.Equal(t, "host", entry.Hostname)
+	assert.Nil(t, entry.StructuredData)
+}
+
+func TestParseRFC5424InvalidMessages(t *testing.T) {
+	tests := []string{
+		``,
+		`<34>`,
+		`34>1 - - su 1234 - - msg`,
+		`<192>1 - - su 1234 - - msg`,
+		`<34>2 - - su 1234 - - msg`,
+		`<34>1 yesterday - su 1234 - - msg`,
+		`<34>1 - - su`,
+		`<34>1 - - su 1234 - [meta group="x" msg`,
+		`<34>1 - - su 1234 - [meta group=x] msg`,
+		`<34>1 - - su 1234 - [meta]msg`,
+	}
+
+	for _, test := range tests {
+		entry, err := ParseRFC5424([]byte(test))
+		assert.Error(t, err, test)
+		assert.Nil(t, entry)
+	}
+}
@@ -2,55 +2,95 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/tylerb/graceful.v1"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/honeybadger-io/honeybadger-go"
-	"github.com/jcxplorer/cwlogger"
 	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
 	"github.com/newrelic/go-agent"
 )
 
 // App is a Heroku HTTPS log drain. It receives log batches as POST requests,
-// parses them, and sends them to CloudWatch Logs.
+// parses them, and sends them to CloudWatch Logs and any other enabled sinks.
 type App struct {
-	retention      int
-	stripAnsiCodes bool
-	user, pass     string
-	parse          logparser.ParseFunc
-	newrelic       newrelic.Application
+	parse    logparser.ParseFunc
+	newrelic newrelic.Application
+
+	// current holds the settings in use, which are replaced as a whole when
+	// the configuration is reloaded.
+	current atomic.Pointer[settings]
 
 	loggers map[string]logger
 	mu      sync.Mutex // protects loggers
+
+	// generation is incremented whenever loggers are closed while the app
+	// is running, so that entry writers stop using them. It is accessed
+	// atomically.
+	generation int64
+
+	// replacing is held for reading by entry writers while they log an
+	// entry, and for writing while loggers are taken out of use, so that no
+	// entry is logged to a logger once it is being closed.
+	replacing sync.RWMutex
+
+	// retiring tracks the loggers being closed after a reload.
+	retiring sync.WaitGroup
 }
 
-type logger interface {
-	Log(t time.Time, s string)
-	Close()
+// settings are the parts of the configuration that can be changed while the
+// app is running. They must not be modified once in use.
+type settings struct {
+	sinks               []namedSink
+	queueSize           int
+	stripAnsiCodes      bool
+	maxBodySize         int64
+	maxDecompressedSize int64
+	maxFrameLength      int
+	maxFrames           int
+	user, pass          string
+	metricsUser         string
+	metricsPass         string
+	adminUser           string
+	adminPass           string
+	credentials         map[string]drainCredentials
+	passwords           *passwordCache
+	authLimiter         *authLimiter
+	trustForwardedFor   bool
+	routes              routes
+	credentialsCheck    *credentialsCheck
+
+	// options are the options the settings were made from, if any.
+	options *options
 }
 
-func main() {
-	var bind, user, pass string
-	var retention int
-	var stripAnsiCodes bool
+// settings returns the settings in use.
+func (app *App) settings() *settings {
+	if s := app.current.Load(); s != nil {
+		return s
+	}
+	return &settings{}
+}
 
-	flag.StringVar(&bind, "bind", ":8080", "address to bind to")
-	flag.IntVar(&retention, "retention", 0, "log retention in days for new log groups")
-	flag.StringVar(&user, "user", "", "username for HTTP basic auth")
-	flag.StringVar(&pass, "pass", "", "password for HTTP basic auth")
-	flag.BoolVar(&stripAnsiCodes, "strip-ansi-codes", false, "strip ANSI codes from log messages")
-	flag.Parse()
+func main() {
+	o, err := parseOptions(os.Args[0], os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 
 	nrAppName := os.Getenv("NEW_RELIC_APP_NAME")
 	if nrAppName == "" {
@@ -67,15 +107,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	s, err := newSettings(o, nil)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 	app := &App{
-		retention:      retention,
-		user:           user,
-		pass:           pass,
-		stripAnsiCodes: stripAnsiCodes,
-		parse:          logparser.Parse,
-		loggers:        make(map[string]logger),
-		newrelic:       nrApp,
+		parse:    logparser.Parse,
+		loggers:  make(map[string]logger),
+		newrelic: nrApp,
 	}
+	app.current.Store(s)
+	go app.watchConfig(os.Args[0], os.Args[1:], o.configCheckInterval)
 
 	if honeybadger.Config.APIKey == "" {
 		honeybadger.Configure(honeybadger.Configuration{Backend: honeybadger.NewNullBackend()})
@@ -90,18 +133,83 @@ func main() {
 		},
 	)
 
+	var listeners []interface{ Close() }
+	if o.syslogTCP != "" {
+		l, err := net.Listen("tcp", o.syslogTCP)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, app.listenSyslog("tcp", l, o.syslogRules, o.syslogGroup, o.syslogGroupParam))
+	}
+	if o.syslogTLS != "" {
+		config, err := newSyslogTLSConfig(o.syslogTLSCert, o.syslogTLSKey, o.syslogTLSClientCA)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		l, err := tls.Listen("tcp", o.syslogTLS, config)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, app.listenSyslog("tls", l, o.syslogRules, o.syslogGroup, o.syslogGroupParam))
+	}
+	if o.syslogUDP != "" {
+		conn, err := net.ListenPacket("udp", o.syslogUDP)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, app.listenSyslogPackets("udp", conn, o.syslogRules, o.syslogGroup, o.syslogGroupParam))
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle(newrelic.WrapHandle(nrApp, "/", honeybadger.Handler(app)))
-	err = graceful.RunWithErr(bind, 5*time.Second, mux)
+	err = graceful.RunWithErr(o.bind, 5*time.Second, mux)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 
+	for _, l := range listeners {
+		l.Close()
+	}
 	app.Stop()
 }
 
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		switch r.URL.Path {
+		case metricsPath:
+			app.serveMetrics(w, r)
+			return
+		case livenessPath:
+			app.serveLiveness(w, r)
+			return
+		case readinessPath:
+			app.serveReadiness(w, r)
+			return
+		}
+	}
+
+	txn, _ := w.(newrelic.Transaction)
+	rec := &statusRecorder{ResponseWriter: w}
+	switch {
+	case strings.HasPrefix(r.URL.Path, adminPathPrefix):
+		app.serveAdmin(rec, r)
+	case r.URL.Path == otlpLogsPath:
+		app.serveOTLP(rec, r)
+	case strings.HasPrefix(r.URL.Path, jsonPathPrefix):
+		app.serveJSON(rec, r)
+	default:
+		app.serveDrain(rec, r, txn)
+	}
+	requestsTotal.With(strconv.Itoa(rec.statusCode()), rec.metricsGroup()).Inc()
+}
+
+// serveDrain receives log batches from Heroku, for the log group in the path.
+func (app *App) serveDrain(w http.ResponseWriter, r *http.Request, txn newrelic.Transaction) {
 	appName := r.URL.Path[1:]
 
 	// honeybadger.SetContext(honeybadger.Context{
@@ -131,27 +239,21 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, pass, _ := r.BasicAuth()
-	if user != app.user || pass != app.pass {
-		w.WriteHeader(http.StatusForbidden)
+	if !app.authenticate(w, r, appName) || !app.decodeBody(w, r) {
 		return
 	}
+	countAs(w, appName)
 
-	txn, _ := w.(newrelic.Transaction)
 	if txn != nil {
 		if err := txn.AddAttribute("AppName", appName); nil != err {
 			log.Printf("failed to add New Relic attribute for app %s: %s\n", appName, err)
 		}
 	}
 
-	l, err := app.logger(appName)
-	if err != nil {
-		log.Printf("failed to create logger for app %s: %s\n", appName, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if err = app.processMessages(r.Body, l, txn); err != nil {
+	if err := app.processMessages(r.Body, appName, txn); err != nil {
+		if app.tooLarge(w, r, err) || invalidBody(w, err) {
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		honeybadger.Notify(err)
 		log.Println(err)
@@ -174,6 +276,7 @@ func (app *App) Stop() {
 		}(l)
 	}
 	wg.Wait()
+	app.retiring.Wait()
 }
 
 func (app *App) logger(appName string) (l logger, err error) {
@@ -181,30 +284,80 @@ func (app *App) logger(appName string) (l logger, err error) {
 	defer app.mu.Unlock()
 	l, ok := app.loggers[appName]
 	if !ok {
-		l, err = cwlogger.New(&cwlogger.Config{
-			LogGroupName: appName,
-			Retention:    app.retention,
-			Client:       cloudwatchlogs.New(session.New()),
-			ErrorReporter: func(err error) {
-				honeybadger.Notify(err)
-			},
-		})
+		s := app.settings()
+		l, err = newFanoutLogger(appName, s.sinks, s.queueSize)
+		if err != nil {
+			return nil, err
+		}
 		app.loggers[appName] = l
+		activeLoggers.With().Inc()
 	}
-	return l, err
+	return l, nil
+}
+
+// An entryWriter writes the entries received in a single request or over a
+// single connection. It strips ANSI codes if enabled and routes the entries,
+// and keeps hold of the loggers it uses so that the app lock isn't taken for
+// every entry.
+type entryWriter struct {
+	app        *App
+	loggers    map[string]logger
+	generation int64
 }
 
-func (app *App) processMessages(r io.Reader, l logger, txn newrelic.Transaction) error {
+func (app *App) newEntryWriter() *entryWriter {
+	return &entryWriter{
+		app:        app,
+		loggers:    make(map[string]logger),
+		generation: atomic.LoadInt64(&app.generation),
+	}
+}
+
+// write logs an entry that was sent to the given log group.
+func (w *entryWriter) write(group string, e *logparser.LogEntry) error {
+	s := w.app.settings()
+	if s.stripAnsiCodes {
+		e.Message = stripAnsi(e.Message)
+	}
+	group = s.routes.group(group, e)
+	w.app.replacing.RLock()
+	defer w.app.replacing.RUnlock()
+	if gen := atomic.LoadInt64(&w.app.generation); gen != w.generation {
+		w.loggers = make(map[string]logger)
+		w.generation = gen
+	}
+	l, ok := w.loggers[group]
+	if !ok {
+		var err error
+		if l, err = w.app.logger(group); err != nil {
+			return fmt.Errorf("failed to create logger for log group %s: %s", group, err)
+		}
+		w.loggers[group] = l
+	}
+	l.Log(e)
+	return nil
+}
+
+// processMessages reads and parses all the frames of a request before writing
+// any of them, so that a request rejected for an invalid frame or for going
+// over a limit can be sent again without duplicating entries.
+func (app *App) processMessages(r io.Reader, appName string, txn newrelic.Transaction) error {
 	if txn != nil {
 		defer newrelic.StartSegment(txn, "processMessages").End()
 	}
+	s := app.settings()
+	var entries []*logparser.LogEntry
 	buf := bufio.NewReader(r)
 	eof := false
-	for {
-		b, err := buf.ReadBytes('\n')
+	for frames := 1; ; frames++ {
+		b, err := readFrame(buf, s.maxFrameLength)
 		if err != nil {
 			if err == io.EOF {
 				eof = true
+			} else if _, ok := err.(*tooLargeError); ok {
+				return err
+			} else if _, ok := err.(*invalidBodyError); ok {
+				return err
 			} else {
 				honeybadger.Notify(err)
 				return fmt.Errorf("failed to scan request body: %s", err)
@@ -213,23 +366,31 @@ func (app *App) processMessages(r io.Reader, l logger, txn newrelic.Transaction)
 		if eof && len(b) == 0 {
 			break
 		}
+		if s.maxFrames > 0 && frames > s.maxFrames {
+			return &tooLargeError{"frames", int64(s.maxFrames)}
+		}
 		entry, err := app.parse(b)
 		if err != nil {
+			framesTotal.With("failed").Inc()
 			honeybadger.Notify(err)
 			return fmt.Errorf("unable to parse message: %s, error: %s", string(b), err)
 		}
-		m := entry.Message
-		if app.stripAnsiCodes {
-			m = stripAnsi(m)
-		}
+		framesTotal.With("parsed").Inc()
 		if !eof {
-			m = m[:len(m)-1]
+			entry.Message = entry.Message[:len(entry.Message)-1]
 		}
-		l.Log(entry.Time, m)
+		entries = append(entries, entry)
 		if eof {
 			break
 		}
 	}
+
+	w := app.newEntryWriter()
+	for _, entry := range entries {
+		if err := w.write(appName, entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -8,22 +8,33 @@ import (
 	"testing"
 	"time"
 
+	"github.com/honeybadger-io/honeybadger-go"
 	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func init() {
+	honeybadger.Configure(honeybadger.Configuration{Backend: honeybadger.NewNullBackend()})
+}
+
 var l = new(LastMessageLogger)
 var parseFunc = func(b []byte) (*logparser.LogEntry, error) {
 	return &logparser.LogEntry{Time: time.Now(), Message: ""}, nil
 }
 
-var app = &App{
+var app = withSettings(&App{
 	loggers: map[string]logger{"app": l},
 	parse:   parseFunc,
-}
+}, &settings{})
 var server = httptest.NewServer(app)
 
+// withSettings makes the app use the settings, and returns it.
+func withSettings(app *App, s *settings) *App {
+	app.current.Store(s)
+	return app
+}
+
 func TestRequestNotFoundWithGet(t *testing.T) {
 	r, err := http.Get(server.URL + "/app")
 	assert.NoError(t, err)
@@ -37,16 +48,17 @@ func TestRequestPathMustBeAppName(t *testing.T) {
 }
 
 func TestBasicAuth(t *testing.T) {
-	app.user = "me"
-	app.pass = "SECRET"
+	app.settings().user = "me"
+	app.settings().pass = "SECRET"
 	defer func() {
-		app.user = ""
-		app.pass = ""
+		app.settings().user = ""
+		app.settings().pass = ""
 	}()
 
 	r, err := http.Post(server.URL+"/app", "", nil)
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusForbidden, r.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+	assert.Equal(t, `Basic realm="heroku-cloudwatch-drain"`, r.Header.Get("WWW-Authenticate"))
 
 	uri, _ := url.Parse(server.URL)
 	uri.User = url.UserPassword("me", "SECRET")
@@ -90,10 +102,10 @@ func TestLogEntryWithEmptyLineAtTheEnd(t *testing.T) {
 
 func TestAnsiCodeStripping(t *testing.T) {
 	app.parse = logparser.Parse
-	app.stripAnsiCodes = true
+	app.settings().stripAnsiCodes = true
 	defer func() {
 		app.parse = parseFunc
-		app.stripAnsiCodes = false
+		app.settings().stripAnsiCodes = false
 	}()
 
 	body := bytes.NewBuffer([]byte(`89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - [1m[36m(0.1ms)[0m [1mBEGIN[0m`))
@@ -103,12 +115,32 @@ func TestAnsiCodeStripping(t *testing.T) {
 	assert.Equal(t, "heroku[web.1]: (0.1ms) BEGIN", l.m)
 }
 
+func TestRouting(t *testing.T) {
+	router := new(LastMessageLogger)
+	app.parse = logparser.Parse
+	app.loggers["app/router"] = router
+	app.settings().routes = routes{{appName: "heroku", procID: "router", group: "{group}/router"}}
+	defer func() {
+		app.parse = parseFunc
+		app.settings().routes = nil
+		delete(app.loggers, "app/router")
+	}()
+
+	body := bytes.NewBuffer([]byte("89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku router - at=info method=GET path=\"/\"\n" +
+		"89 <45>1 2016-10-15T08:59:08.723822+00:00 host app web.1 - Started GET \"/\"\n"))
+	r, err := http.Post(server.URL+"/app", "", body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, r.StatusCode)
+	assert.Equal(t, `heroku[router]: at=info method=GET path="/"`, router.m)
+	assert.Equal(t, `app[web.1]: Started GET "/"`, l.m)
+}
+
 type LastMessageLogger struct {
 	m string
 }
 
-func (l *LastMessageLogger) Log(t time.Time, s string) {
-	l.m = s
+func (l *LastMessageLogger) Log(e *logparser.LogEntry) {
+	l.m = e.Message
 }
 
 func (l *LastMessageLogger) Close() {}
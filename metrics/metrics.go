@@ -0,0 +1,271 @@
+// Package metrics implements the counters and other instruments the drain uses
+// to keep track of what it's doing.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Counter is a value that only ever goes up. It is safe for concurrent use.
+type Counter struct {
+	v int64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by n, which must not be negative.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// A CounterVec is a set of counters sharing the same name, partitioned by the
+// values of one or more labels.
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu       sync.Mutex
+	counters map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	Counter
+	values []string
+}
+
+// NewCounterVec returns a new CounterVec with the given name, help text and
+// label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		Name:     name,
+		Help:     help,
+		Labels:   labels,
+		counters: make(map[string]*labeledCounter),
+	}
+}
+
+// With returns the counter for the given label values, creating it if needed.
+// The number of values must match the number of labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.Labels) {
+		panic("metrics: wrong number of label values for " + v.Name)
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &labeledCounter{values: append([]string(nil), values...)}
+		v.counters[key] = c
+	}
+	return &c.Counter
+}
+
+// Each calls fn for every counter in the set, with its label values.
+func (v *CounterVec) Each(fn func(values []string, c *Counter)) {
+	v.mu.Lock()
+	counters := make([]*labeledCounter, 0, len(v.counters))
+	for _, c := range v.counters {
+		counters = append(counters, c)
+	}
+	v.mu.Unlock()
+	for _, c := range counters {
+		fn(c.values, &c.Counter)
+	}
+}
+
+// A Gauge is a value that can go up and down. It is safe for concurrent use.
+type Gauge struct {
+	v int64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds n to the gauge, which may be negative.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// A GaugeVec is a set of gauges sharing the same name, partitioned by the
+// values of zero or more labels.
+type GaugeVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	gauges map[string]*labeledGauge
+}
+
+type labeledGauge struct {
+	Gauge
+	values []string
+}
+
+// NewGaugeVec returns a new GaugeVec with the given name, help text and label
+// names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		gauges: make(map[string]*labeledGauge),
+	}
+}
+
+// With returns the gauge for the given label values, creating it if needed.
+// The number of values must match the number of labels.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	if len(values) != len(v.Labels) {
+		panic("metrics: wrong number of label values for " + v.Name)
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g, ok := v.gauges[key]
+	if !ok {
+		g = &labeledGauge{values: append([]string(nil), values...)}
+		v.gauges[key] = g
+	}
+	return &g.Gauge
+}
+
+// Each calls fn for every gauge in the set, with its label values.
+func (v *GaugeVec) Each(fn func(values []string, g *Gauge)) {
+	v.mu.Lock()
+	gauges := make([]*labeledGauge, 0, len(v.gauges))
+	for _, g := range v.gauges {
+		gauges = append(gauges, g)
+	}
+	v.mu.Unlock()
+	for _, g := range gauges {
+		fn(g.values, &g.Gauge)
+	}
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets suitable for
+// request durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A Histogram counts observed values in buckets. It is safe for concurrent
+// use.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, in increasing order
+	counts  []int64   // non-cumulative counts, with a last one for +Inf
+	sum     float64
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Snapshot returns the cumulative counts of the buckets, the last one being
+// the total count, and the sum of the observed values.
+func (h *Histogram) Snapshot() (counts []int64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts = make([]int64, len(h.counts))
+	var total int64
+	for i, c := range h.counts {
+		total += c
+		counts[i] = total
+	}
+	return counts, h.sum
+}
+
+// A HistogramVec is a set of histograms sharing the same name and buckets,
+// partitioned by the values of zero or more labels.
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	mu         sync.Mutex
+	histograms map[string]*labeledHistogram
+}
+
+type labeledHistogram struct {
+	Histogram
+	values []string
+}
+
+// NewHistogramVec returns a new HistogramVec with the given name, help text,
+// bucket upper bounds and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		Name:       name,
+		Help:       help,
+		Labels:     labels,
+		Buckets:    buckets,
+		histograms: make(map[string]*labeledHistogram),
+	}
+}
+
+// With returns the histogram for the given label values, creating it if
+// needed. The number of values must match the number of labels.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if len(values) != len(v.Labels) {
+		panic("metrics: wrong number of label values for " + v.Name)
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &labeledHistogram{values: append([]string(nil), values...)}
+		h.buckets = v.Buckets
+		h.counts = make([]int64, len(v.Buckets)+1)
+		v.histograms[key] = h
+	}
+	return &h.Histogram
+}
+
+// Each calls fn for every histogram in the set, with its label values.
+func (v *HistogramVec) Each(fn func(values []string, h *Histogram)) {
+	v.mu.Lock()
+	histograms := make([]*labeledHistogram, 0, len(v.histograms))
+	for _, h := range v.histograms {
+		histograms = append(histograms, h)
+	}
+	v.mu.Unlock()
+	for _, h := range histograms {
+		fn(h.values, &h.Histogram)
+	}
+}
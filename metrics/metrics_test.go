@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	var c Counter
+	c.Inc()
+	c.Add(2)
+	assert.Equal(t, int64(3), c.Value())
+}
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("requests_total", "Requests.", "status", "group")
+	v.With("200", "a").Inc()
+	v.With("200", "a").Inc()
+	v.With("500", "a").Inc()
+
+	assert.Equal(t, int64(2), v.With("200", "a").Value())
+	assert.Equal(t, int64(1), v.With("500", "a").Value())
+	assert.Equal(t, int64(0), v.With("200", "b").Value())
+
+	total := int64(0)
+	v.Each(func(values []string, c *Counter) {
+		assert.Len(t, values, 2)
+		total += c.Value()
+	})
+	assert.Equal(t, int64(3), total)
+
+	assert.Panics(t, func() { v.With("200") })
+}
+
+func TestGaugeVec(t *testing.T) {
+	v := NewGaugeVec("queue_depth", "Queue depth.", "sink")
+	v.With("s3").Inc()
+	v.With("s3").Add(3)
+	v.With("s3").Dec()
+	v.With("file").Set(7)
+
+	assert.Equal(t, int64(3), v.With("s3").Value())
+	assert.Equal(t, int64(7), v.With("file").Value())
+	assert.Panics(t, func() { v.With() })
+
+	loggers := NewGaugeVec("loggers", "Loggers.")
+	loggers.With().Inc()
+	assert.Equal(t, int64(1), loggers.With().Value())
+}
+
+func TestHistogramVec(t *testing.T) {
+	v := NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	h := v.With("put")
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	counts, sum := h.Snapshot()
+	assert.Equal(t, []int64{2, 3, 4}, counts)
+	assert.InDelta(t, 2.65, sum, 1e-9)
+	assert.Panics(t, func() { v.With() })
+}
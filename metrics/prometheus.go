@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Collector is a set of metrics that can be written in the Prometheus text
+// format, such as a CounterVec.
+type Collector interface {
+	writeText(w *bufio.Writer)
+}
+
+// A Registry holds the collectors exposed by a Prometheus endpoint.
+type Registry struct {
+	collectors []Collector
+}
+
+// NewRegistry returns a registry with the given collectors.
+func NewRegistry(collectors ...Collector) *Registry {
+	return &Registry{collectors: collectors}
+}
+
+// WriteText writes all the metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, c := range r.collectors {
+		c.writeText(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func (v *CounterVec) writeText(w *bufio.Writer) {
+	writeHeader(w, v.Name, v.Help, "counter")
+	var samples []sample
+	v.Each(func(values []string, c *Counter) {
+		samples = append(samples, sample{labels(v.Labels, values), float64(c.Value())})
+	})
+	writeSamples(w, v.Name, samples)
+}
+
+func (v *GaugeVec) writeText(w *bufio.Writer) {
+	writeHeader(w, v.Name, v.Help, "gauge")
+	var samples []sample
+	v.Each(func(values []string, g *Gauge) {
+		samples = append(samples, sample{labels(v.Labels, values), float64(g.Value())})
+	})
+	writeSamples(w, v.Name, samples)
+}
+
+func (v *HistogramVec) writeText(w *bufio.Writer) {
+	writeHeader(w, v.Name, v.Help, "histogram")
+	type series struct {
+		labels string
+		values []string
+		counts []int64
+		sum    float64
+	}
+	var all []series
+	v.Each(func(values []string, h *Histogram) {
+		counts, sum := h.Snapshot()
+		all = append(all, series{labels(v.Labels, values), values, counts, sum})
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+	for _, s := range all {
+		for i, c := range s.counts {
+			le := math.Inf(1)
+			if i < len(v.Buckets) {
+				le = v.Buckets[i]
+			}
+			bucketLabels := labels(append(append([]string(nil), v.Labels...), "le"), append(append([]string(nil), s.values...), formatFloat(le)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.Name, bucketLabels, c)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.Name, s.labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.Name, s.labels, s.counts[len(s.counts)-1])
+	}
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeSamples writes samples sorted by their labels, so that the output is
+// stable.
+func writeSamples(w *bufio.Writer, name string, samples []sample) {
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, s.labels, formatFloat(s.value))
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label names and values as {name="value",...}, or an empty
+// string if there are no labels.
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	requests := NewCounterVec("requests_total", "Requests.", "status", "group")
+	requests.With("202", "app").Add(2)
+	requests.With("401", `a"b\c`).Inc()
+
+	loggers := NewGaugeVec("loggers", "Active\nloggers.")
+	loggers.With().Set(3)
+
+	latency := NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	latency.With("put").Observe(0.5)
+
+	var b bytes.Buffer
+	assert.NoError(t, NewRegistry(requests, loggers, latency).WriteText(&b))
+	assert.Equal(t, `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{status="202",group="app"} 2
+requests_total{status="401",group="a\"b\\c"} 1
+# HELP loggers Active\nloggers.
+# TYPE loggers gauge
+loggers 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="put",le="0.1"} 0
+latency_seconds_bucket{op="put",le="1"} 1
+latency_seconds_bucket{op="put",le="+Inf"} 1
+latency_seconds_sum{op="put"} 0.5
+latency_seconds_count{op="put"} 1
+`, b.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	c := NewCounterVec("events_total", "Events.")
+	c.With().Inc()
+
+	w := httptest.NewRecorder()
+	NewRegistry(c).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "events_total 1\n")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// jsonPathPrefix is the prefix of the paths of the NDJSON endpoint, which is
+// followed by the log group.
+const jsonPathPrefix = "/_json/"
+
+// serveJSON receives entries as NDJSON, one JSON object per line:
+//
+//	{"timestamp": "2017-10-15T08:59:08Z", "message": "job done", "fields": {"job": "backup"}}
+//
+// Only message is required. The whole request is rejected if any line is
+// invalid, so that it can be fixed and sent again without duplicating entries.
+func (app *App) serveJSON(w http.ResponseWriter, r *http.Request) {
+	group := strings.TrimPrefix(r.URL.Path, jsonPathPrefix)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("The only accepted request method is POST"))
+		return
+	}
+	if group == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Request path must specify the log group name"))
+		return
+	}
+	if !app.authenticate(w, r, group) || !app.decodeBody(w, r) {
+		return
+	}
+	countAs(w, group)
+
+	s := app.settings()
+	entries, err := readJSONEntries(r.Body, time.Now(), s.maxFrameLength, s.maxFrames)
+	if err != nil {
+		if app.tooLarge(w, r, err) || invalidBody(w, err) {
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	ew := app.newEntryWriter()
+	for _, e := range entries {
+		if err := ew.write(group, e); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			honeybadger.Notify(err)
+			log.Println(err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// A jsonInput is a line received by the NDJSON endpoint. It accepts the field
+// names of jsonEntry too, so that the output of the file sink can be sent
+// again.
+type jsonInput struct {
+	Timestamp json.RawMessage        `json:"timestamp"`
+	Time      json.RawMessage        `json:"time"`
+	Message   *string                `json:"message"`
+	Hostname  string                 `json:"hostname"`
+	AppName   string                 `json:"app_name"`
+	ProcID    string                 `json:"proc_id"`
+	Fields    map[string]interface{} `json:"fields"`
+
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// readJSONEntries reads and validates all the lines of an NDJSON body. Entries
+// without a timestamp get the given time. It returns a tooLargeError if a line
+// is longer than maxLength bytes or there are more than maxEntries entries,
+// unless the limit is 0.
+func readJSONEntries(r io.Reader, now time.Time, maxLength, maxEntries int) ([]*logparser.LogEntry, error) {
+	var entries []*logparser.LogEntry
+	buf := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := readFrame(buf, maxLength)
+		switch err.(type) {
+		case *tooLargeError, *invalidBodyError:
+			return nil, err
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read request body: %s", err)
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			e, perr := parseJSONEntry(b, now)
+			if perr != nil {
+				return nil, fmt.Errorf("line %d: %s", line, perr)
+			}
+			if maxEntries > 0 && len(entries) == maxEntries {
+				return nil, &tooLargeError{"frames", int64(maxEntries)}
+			}
+			entries = append(entries, e)
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+	}
+}
+
+func parseJSONEntry(b []byte, now time.Time) (*logparser.LogEntry, error) {
+	var in jsonInput
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	if in.Message == nil {
+		return nil, errors.New("message is required")
+	}
+
+	t := now
+	ts := in.Timestamp
+	if ts == nil {
+		ts = in.Time
+	}
+	if ts != nil && string(ts) != "null" {
+		var err error
+		if t, err = parseJSONTimestamp(ts); err != nil {
+			return nil, err
+		}
+	}
+
+	var attrs map[string]string
+	for _, fields := range []map[string]interface{}{in.Attributes, in.Fields} {
+		for k, v := range fields {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			if s, ok := v.(string); ok {
+				attrs[k] = s
+			} else {
+				b, _ := json.Marshal(v)
+				attrs[k] = string(b)
+			}
+		}
+	}
+
+	return &logparser.LogEntry{
+		Time:       t,
+		Message:    logparser.FormatMessage(in.AppName, in.ProcID, *in.Message),
+		Hostname:   in.Hostname,
+		AppName:    in.AppName,
+		ProcID:     in.ProcID,
+		Attributes: attrs,
+	}, nil
+}
+
+// parseJSONTimestamp parses an RFC 3339 timestamp, or a Unix time in seconds
+// or milliseconds. Times after the year 5138 in seconds are taken to be in
+// milliseconds.
+func parseJSONTimestamp(b json.RawMessage) (time.Time, error) {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q, must be RFC 3339", s)
+		}
+		return t, nil
+	}
+
+	var n float64
+	if err := json.Unmarshal(b, &n); err != nil || n < 0 || math.IsInf(n, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", b)
+	}
+	if n >= 1e11 {
+		n /= 1000
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
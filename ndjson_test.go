@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONEndpoint(t *testing.T) {
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := withSettings(&App{loggers: map[string]logger{"cron": l}}, &settings{stripAnsiCodes: true})
+
+	body := `{"timestamp": "2017-10-15T08:59:08.5Z", "message": "backup \u001b[32mdone\u001b[0m", "fields": {"job": "backup", "files": 12}}
+
+{"time": 1508057948, "message": "from seconds", "app_name": "lambda", "proc_id": "1", "hostname": "host"}
+{"timestamp": 1508057948250, "message": "from milliseconds", "attributes": {"a": "b"}}`
+	req := httptest.NewRequest(http.MethodPost, "/_json/cron", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	e := <-l.entries
+	assert.Equal(t, "backup done", e.Message)
+	assert.Equal(t, time.Date(2017, 10, 15, 8, 59, 8, 500000000, time.UTC), e.Time)
+	assert.Equal(t, map[string]string{"job": "backup", "files": "12"}, e.Attributes)
+
+	e = <-l.entries
+	assert.Equal(t, "lambda[1]: from seconds", e.Message)
+	assert.True(t, time.Unix(1508057948, 0).Equal(e.Time))
+	assert.Equal(t, "host", e.Hostname)
+	assert.Nil(t, e.Attributes)
+
+	e = <-l.entries
+	assert.Equal(t, "from milliseconds", e.Message)
+	assert.True(t, time.Unix(1508057948, 250000000).Equal(e.Time))
+	assert.Equal(t, map[string]string{"a": "b"}, e.Attributes)
+}
+
+func TestJSONEndpointInvalidRequests(t *testing.T) {
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := &App{loggers: map[string]logger{"cron": l}}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		message            string
+	}{
+		{http.MethodGet, "/_json/cron", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/_json/", `{"message": "x"}`, http.StatusBadRequest, "Request path must specify the log group name"},
+		{http.MethodPost, "/_json/cron", `{"message": "ok"}` + "\nnot json", http.StatusBadRequest, "line 2: invalid character"},
+		{http.MethodPost, "/_json/cron", `{"msg": "x"}`, http.StatusBadRequest, "line 1: message is required"},
+		{http.MethodPost, "/_json/cron", `{"message": "x", "timestamp": "yesterday"}`, http.StatusBadRequest, `line 1: invalid timestamp "yesterday", must be RFC 3339`},
+		{http.MethodPost, "/_json/cron", `{"message": "x", "timestamp": true}`, http.StatusBadRequest, "line 1: invalid timestamp true"},
+		{http.MethodPost, "/_json/cron", `["message"]`, http.StatusBadRequest, "line 1: json: cannot unmarshal"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, test.body)
+		assert.True(t, strings.HasPrefix(w.Body.String(), test.message), w.Body.String())
+	}
+	assert.Empty(t, l.entries)
+}
+
+func TestJSONEndpointAuthentication(t *testing.T) {
+	app := withSettings(&App{loggers: map[string]logger{}}, &settings{user: "me", pass: "secret"})
+	req := httptest.NewRequest(http.MethodPost, "/_json/cron", strings.NewReader(`{"message": "x"}`))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+const (
+	openSearchMaxItems    = 1000
+	openSearchMaxBytes    = 5 * 1024 * 1024
+	openSearchMaxAttempts = 5
+)
+
+// openSearchSink indexes entries in OpenSearch or Elasticsearch through the
+// _bulk API. Each log group gets a daily index named after it, e.g.
+// logs-my-app-2017.10.15.
+type openSearchSink struct {
+	url         *url.URL
+	indexPrefix string
+	interval    time.Duration
+	client      *http.Client
+}
+
+func newOpenSearchSink(c *sinkConfig) (sink, error) {
+	if c.openSearchURL == "" {
+		return nil, errors.New("no URL given")
+	}
+	if c.openSearchFlushInterval <= 0 {
+		return nil, errors.New("the flush interval must be positive")
+	}
+	u, err := url.Parse(c.openSearchURL)
+	if err != nil {
+		return nil, err
+	}
+	return &openSearchSink{
+		url:         u,
+		indexPrefix: c.openSearchIndexPrefix,
+		interval:    c.openSearchFlushInterval,
+		client:      &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *openSearchSink) logger(group string) (logger, error) {
+	name := s.indexPrefix + indexName(group)
+	encode := func(e *logparser.LogEntry) (batchItem, error) {
+		return s.encode(name, group, e)
+	}
+	return newBatchLogger("opensearch", openSearchMaxItems, openSearchMaxBytes, s.interval, encode, s.bulk), nil
+}
+
+// indexName turns a log group name into something that is valid in an index
+// name: lowercase, and without characters such as slashes and spaces.
+func indexName(group string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '-'
+		}
+		return r
+	}, strings.ToLower(group))
+	return strings.TrimLeft(name, "-_+")
+}
+
+type openSearchDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Message   string    `json:"message"`
+	Group     string    `json:"group"`
+	Hostname  string    `json:"hostname,omitempty"`
+	AppName   string    `json:"app_name,omitempty"`
+	ProcID    string    `json:"proc_id,omitempty"`
+
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// encode returns the action and document lines for an entry.
+func (s *openSearchSink) encode(name, group string, e *logparser.LogEntry) (batchItem, error) {
+	t := e.Time.UTC()
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": name + "-" + t.Format("2006.01.02")},
+	})
+	if err != nil {
+		return batchItem{}, err
+	}
+	doc, err := json.Marshal(&openSearchDocument{
+		Timestamp: t,
+		Message:   e.Message,
+		Group:     group,
+		Hostname:  e.Hostname,
+		AppName:   e.AppName,
+		ProcID:    e.ProcID,
+
+		Attributes: e.Attributes,
+	})
+	if err != nil {
+		return batchItem{}, err
+	}
+	data := append(action, '\n')
+	data = append(data, doc...)
+	data = append(data, '\n')
+	return batchItem{data: data}, nil
+}
+
+// bulk indexes the documents, retrying the ones rejected with 429 Too Many
+// Requests, and the whole request on server and network errors.
+func (s *openSearchSink) bulk(items []batchItem) {
+	wait := retryBackoff
+	var err error
+	var rejected []string
+	for attempt := 0; attempt < openSearchMaxAttempts && len(items) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		var retry []batchItem
+		retry, rejected, err = s.send(items)
+		if err != nil {
+			if e, ok := err.(*openSearchError); ok && !e.Temporary() {
+				break
+			}
+			continue
+		}
+		if len(rejected) > 0 {
+			eventsDropped.With("opensearch").Add(int64(len(rejected)))
+			reportOpenSearchError(fmt.Errorf("%d documents rejected, first error: %s", len(rejected), rejected[0]))
+		}
+		items = retry
+	}
+
+	if len(items) > 0 {
+		if err == nil {
+			err = errors.New("documents rejected after retries")
+		}
+		eventsDropped.With("opensearch").Add(int64(len(items)))
+		err = fmt.Errorf("failed to index %d documents: %s", len(items), err)
+		healthOf("opensearch").fail()
+		reportOpenSearchError(err)
+		return
+	}
+	healthOf("opensearch").succeed()
+}
+
+func reportOpenSearchError(err error) {
+	err = fmt.Errorf("opensearch: %s", err)
+	honeybadger.Notify(err)
+	log.Println(err)
+}
+
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  json.RawMessage
+	}
+}
+
+// send makes a single _bulk request. It returns the items that should be
+// retried, and the errors of the items that were rejected for good.
+func (s *openSearchSink) send(items []batchItem) ([]batchItem, []string, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.data)
+	}
+
+	u := *s.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_bulk"
+	u.User = nil
+	req, err := http.NewRequest(http.MethodPost, u.String(), &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.url.User != nil {
+		pass, _ := s.url.User.Password()
+		req.SetBasicAuth(s.url.User.Username(), pass)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			sinkThrottled.With("opensearch").Inc()
+		}
+		return nil, nil, &openSearchError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, nil, err
+	}
+	if !result.Errors {
+		return nil, nil, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, nil, fmt.Errorf("got %d results for %d documents", len(result.Items), len(items))
+	}
+
+	var retry []batchItem
+	var rejected []string
+	for i, r := range result.Items {
+		for _, status := range r {
+			switch {
+			case status.Status == http.StatusTooManyRequests:
+				sinkThrottled.With("opensearch").Inc()
+				retry = append(retry, items[i])
+			case status.Status >= 300:
+				rejected = append(rejected, string(status.Error))
+			}
+		}
+	}
+	return retry, rejected, nil
+}
+
+// An openSearchError is an error response to a _bulk request.
+type openSearchError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *openSearchError) Error() string {
+	return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *openSearchError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeOpenSearch accepts _bulk requests. Documents with the message "reject"
+// are rejected, and the first document of every request is rejected with 429
+// while throttled is greater than zero.
+type FakeOpenSearch struct {
+	mu        sync.Mutex
+	throttled int
+	indices   []string
+	docs      []openSearchDocument
+}
+
+func (f *FakeOpenSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var result bulkResponse
+	scanner := bufio.NewScanner(r.Body)
+	for i := 0; scanner.Scan(); i++ {
+		var action struct {
+			Index struct {
+				Index string `json:"_index"`
+			}
+		}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc openSearchDocument
+		json.Unmarshal(scanner.Bytes(), &doc)
+
+		status := http.StatusCreated
+		switch {
+		case i == 0 && f.throttled > 0:
+			f.throttled--
+			status = http.StatusTooManyRequests
+		case doc.Message == "reject":
+			status = http.StatusBadRequest
+		default:
+			f.indices = append(f.indices, action.Index.Index)
+			f.docs = append(f.docs, doc)
+		}
+		if status != http.StatusCreated {
+			result.Errors = true
+		}
+		result.Items = append(result.Items, map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}{"index": {Status: status, Error: json.RawMessage(`{"type":"mapper_parsing_exception"}`)}})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": result.Errors, "items": result.Items})
+}
+
+func newTestOpenSearchSink(t *testing.T, u string) sink {
+	s, err := newOpenSearchSink(&sinkConfig{
+		openSearchURL:           strings.Replace(u, "http://", "http://user:pass@", 1),
+		openSearchIndexPrefix:   "logs-",
+		openSearchFlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestOpenSearchSink(t *testing.T) {
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = 500 * time.Millisecond }()
+
+	fake := &FakeOpenSearch{throttled: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := newTestOpenSearchSink(t, server.URL).logger("My App/web")
+	assert.NoError(t, err)
+
+	throttled := sinkThrottled.With("opensearch").Value()
+	dropped := eventsDropped.With("opensearch").Value()
+	ts := time.Date(2017, 10, 15, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+	for _, msg := range []string{"0", "reject", "2"} {
+		l.Log(&logparser.LogEntry{Time: ts, Message: msg, AppName: "app", ProcID: "web.1"})
+	}
+	l.Close()
+
+	assert.Len(t, fake.docs, 2)
+	assert.Equal(t, []string{"logs-my-app-web-2017.10.16", "logs-my-app-web-2017.10.16"}, fake.indices)
+	assert.Equal(t, throttled+2, sinkThrottled.With("opensearch").Value())
+	assert.Equal(t, dropped+1, eventsDropped.With("opensearch").Value())
+
+	var messages []string
+	for _, doc := range fake.docs {
+		messages = append(messages, doc.Message)
+	}
+	assert.ElementsMatch(t, []string{"0", "2"}, messages)
+	assert.Equal(t, "My App/web", fake.docs[0].Group)
+	assert.Equal(t, "app", fake.docs[0].AppName)
+	assert.Equal(t, "web.1", fake.docs[0].ProcID)
+	assert.True(t, ts.Equal(fake.docs[0].Timestamp))
+}
+
+func TestOpenSearchSinkPermanentError(t *testing.T) {
+	server := httptest.NewServer(&FakeOpenSearch{})
+	defer server.Close()
+
+	s, err := newOpenSearchSink(&sinkConfig{
+		openSearchURL:           strings.Replace(server.URL, "http://", "http://user:wrong@", 1),
+		openSearchFlushInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+
+	dropped := eventsDropped.With("opensearch").Value()
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	l.Close()
+
+	assert.Equal(t, dropped+1, eventsDropped.With("opensearch").Value())
+}
+
+func TestOpenSearchSinkNoURL(t *testing.T) {
+	_, err := newOpenSearchSink(&sinkConfig{})
+	assert.Error(t, err)
+}
+
+func TestOpenSearchSinkInvalidFlushInterval(t *testing.T) {
+	_, err := newOpenSearchSink(&sinkConfig{openSearchURL: "http://localhost:9200"})
+	assert.Error(t, err)
+}
+
+func TestIndexName(t *testing.T) {
+	for group, expected := range map[string]string{
+		"app":             "app",
+		"My-App":          "my-app",
+		"/aws/heroku/app": "aws-heroku-app",
+		"a b,c#d:e?f*g|h": "a-b-c-d-e-f-g-h",
+		"_app":            "app",
+		"+app":            "app",
+	} {
+		assert.Equal(t, expected, indexName(group), group)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// otlpLogsPath is the path of the OTLP/HTTP logs endpoint.
+const otlpLogsPath = "/v1/logs"
+
+// otlpDefaultGroup is the log group of log records without a service.name,
+// which is also what OpenTelemetry SDKs call such services.
+const otlpDefaultGroup = "unknown_service"
+
+// otlpMaxDepth is how deep array and key-value list values may be nested.
+// Decoding them recurses, so without a limit a small request could run the
+// drain out of stack.
+const otlpMaxDepth = 64
+
+var errOTLPTooDeep = fmt.Errorf("values are nested more than %d levels deep", otlpMaxDepth)
+
+// serveOTLP receives logs over OTLP/HTTP, encoded either as protobuf or as
+// JSON. Log records are written to the log group named after the service.name
+// resource attribute, and routed from there like any other entry.
+//
+// The log groups are only known once the body is decoded, so requests must
+// first carry credentials that are valid for some log group, and then those of
+// every log group they write to.
+func (app *App) serveOTLP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("The only accepted request method is POST"))
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/x-protobuf" && contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte("Content-Type must be application/x-protobuf or application/json"))
+		return
+	}
+
+	if !app.checkAuth(w, r, "otlp", "otlp", app.authorizedForAny(r)) || !app.decodeBody(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if !app.tooLarge(w, r, err) && !invalidBody(w, err) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	var req otlpLogsRequest
+	if contentType == "application/json" {
+		if err = json.Unmarshal(body, &req); err == nil && req.tooDeep() {
+			err = errOTLPTooDeep
+		}
+	} else {
+		err = req.unmarshalProto(body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to decode request: %s", err)
+		return
+	}
+
+	entries := req.entries(time.Now())
+	authenticated := make(map[string]bool)
+	for _, e := range entries {
+		if !authenticated[e.group] {
+			if !app.authenticate(w, r, e.group) {
+				return
+			}
+			authenticated[e.group] = true
+		}
+	}
+	if max := app.settings().maxFrames; max > 0 && len(entries) > max {
+		app.tooLarge(w, r, &tooLargeError{"frames", int64(max)})
+		return
+	}
+
+	ew := app.newEntryWriter()
+	for _, e := range entries {
+		if err := ew.write(e.group, e.LogEntry); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			honeybadger.Notify(err)
+			log.Println(err)
+			return
+		}
+	}
+
+	// The response is an empty ExportLogsServiceResponse.
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if contentType == "application/json" {
+		w.Write([]byte("{}"))
+	}
+}
+
+// An otlpEntry is a log record converted to an entry, along with the log
+// group it belongs to.
+type otlpEntry struct {
+	*logparser.LogEntry
+	group string
+}
+
+// The following types are the parts of an OTLP ExportLogsServiceRequest that
+// are used, with the field names of its JSON encoding.
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 *otlpAnyValue  `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *otlpInt         `json:"intValue"`
+	DoubleValue *float64         `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue  `json:"arrayValue"`
+	KvlistValue *otlpKvlistValue `json:"kvlistValue"`
+	BytesValue  []byte           `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKvlistValue struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// otlpInt is a 64-bit integer, which the JSON encoding of OTLP gives as a
+// string, although some senders use a number.
+type otlpInt int64
+
+func (i *otlpInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Timestamps are unsigned, and may not fit in an int64 in theory.
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return err
+		}
+		n = int64(u)
+	}
+	*i = otlpInt(n)
+	return nil
+}
+
+// entries converts the log records of the request to entries. Records without
+// a timestamp get the time they were observed at, or else the current time.
+func (req *otlpLogsRequest) entries(now time.Time) []otlpEntry {
+	var entries []otlpEntry
+	for _, rl := range req.ResourceLogs {
+		resource := otlpAttributes(rl.Resource.Attributes)
+		group := resource["service.name"]
+		if group == "" {
+			group = otlpDefaultGroup
+		}
+
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				attrs := make(map[string]string, len(resource)+len(lr.Attributes)+6)
+				for k, v := range resource {
+					attrs[k] = v
+				}
+				setAttribute(attrs, "otel.scope.name", sl.Scope.Name)
+				setAttribute(attrs, "otel.scope.version", sl.Scope.Version)
+				setAttribute(attrs, "severity_text", lr.SeverityText)
+				if lr.SeverityNumber != 0 {
+					attrs["severity_number"] = strconv.Itoa(lr.SeverityNumber)
+				}
+				setAttribute(attrs, "trace_id", lr.TraceID)
+				setAttribute(attrs, "span_id", lr.SpanID)
+				for k, v := range otlpAttributes(lr.Attributes) {
+					attrs[k] = v
+				}
+
+				t := now
+				if lr.TimeUnixNano != 0 {
+					t = time.Unix(0, int64(lr.TimeUnixNano))
+				} else if lr.ObservedTimeUnixNano != 0 {
+					t = time.Unix(0, int64(lr.ObservedTimeUnixNano))
+				}
+
+				var body string
+				if lr.Body != nil {
+					body = lr.Body.String()
+				}
+				appName, procID := resource["service.name"], resource["service.instance.id"]
+				entries = append(entries, otlpEntry{
+					group: group,
+					LogEntry: &logparser.LogEntry{
+						Time:       t,
+						Message:    logparser.FormatMessage(appName, procID, body),
+						Hostname:   resource["host.name"],
+						AppName:    appName,
+						ProcID:     procID,
+						Attributes: attrs,
+					},
+				})
+			}
+		}
+	}
+	return entries
+}
+
+func setAttribute(attrs map[string]string, key, value string) {
+	if value != "" {
+		attrs[key] = value
+	}
+}
+
+// otlpAttributes converts attributes to strings.
+func otlpAttributes(kvs []otlpKeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.Value.String()
+	}
+	return attrs
+}
+
+// String returns strings as they are, and other values as JSON.
+func (v *otlpAnyValue) String() string {
+	if v.StringValue != nil {
+		return *v.StringValue
+	}
+	b, _ := json.Marshal(v.value())
+	return string(b)
+}
+
+// tooDeep reports whether any of the values in the request are nested deeper
+// than otlpMaxDepth. The protobuf decoder checks this as it goes.
+func (req *otlpLogsRequest) tooDeep() bool {
+	for _, rl := range req.ResourceLogs {
+		for _, kv := range rl.Resource.Attributes {
+			if kv.Value.tooDeep(0) {
+				return true
+			}
+		}
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				if lr.Body != nil && lr.Body.tooDeep(0) {
+					return true
+				}
+				for _, kv := range lr.Attributes {
+					if kv.Value.tooDeep(0) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (v *otlpAnyValue) tooDeep(depth int) bool {
+	if depth > otlpMaxDepth {
+		return true
+	}
+	if v.ArrayValue != nil {
+		for i := range v.ArrayValue.Values {
+			if v.ArrayValue.Values[i].tooDeep(depth + 1) {
+				return true
+			}
+		}
+	}
+	if v.KvlistValue != nil {
+		for i := range v.KvlistValue.Values {
+			if v.KvlistValue.Values[i].Value.tooDeep(depth + 1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// value returns the value as a plain Go value.
+func (v *otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		if math.IsNaN(*v.DoubleValue) || math.IsInf(*v.DoubleValue, 0) {
+			return fmt.Sprint(*v.DoubleValue)
+		}
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.value()
+		}
+		return values
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return nil
+}
+
+// The unmarshalProto methods decode the protobuf encoding of the messages,
+// using the field numbers of opentelemetry-proto.
+
+func (req *otlpLogsRequest) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		if field != 1 {
+			return false, nil
+		}
+		var rl otlpResourceLogs
+		err := r.embedded(field, wireType, rl.unmarshalProto)
+		req.ResourceLogs = append(req.ResourceLogs, rl)
+		return true, err
+	})
+}
+
+func (rl *otlpResourceLogs) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		switch field {
+		case 1:
+			return true, r.embedded(field, wireType, rl.Resource.unmarshalProto)
+		case 2:
+			var sl otlpScopeLogs
+			err := r.embedded(field, wireType, sl.unmarshalProto)
+			rl.ScopeLogs = append(rl.ScopeLogs, sl)
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func (res *otlpResource) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		if field != 1 {
+			return false, nil
+		}
+		var kv otlpKeyValue
+		err := r.embedded(field, wireType, kv.unmarshalProto)
+		res.Attributes = append(res.Attributes, kv)
+		return true, err
+	})
+}
+
+func (sl *otlpScopeLogs) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		switch field {
+		case 1:
+			return true, r.embedded(field, wireType, sl.Scope.unmarshalProto)
+		case 2:
+			var lr otlpLogRecord
+			err := r.embedded(field, wireType, lr.unmarshalProto)
+			sl.LogRecords = append(sl.LogRecords, lr)
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func (s *otlpScope) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		var err error
+		switch field {
+		case 1:
+			s.Name, err = r.string(field, wireType)
+		case 2:
+			s.Version, err = r.string(field, wireType)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (lr *otlpLogRecord) unmarshalProto(b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		var err error
+		switch field {
+		case 1, 11:
+			if err = expect(field, wireType, wireFixed64); err != nil {
+				return true, err
+			}
+			var t uint64
+			t, err = r.fixed64()
+			if field == 1 {
+				lr.TimeUnixNano = otlpInt(t)
+			} else {
+				lr.ObservedTimeUnixNano = otlpInt(t)
+			}
+		case 2:
+			if err = expect(field, wireType, wireVarint); err != nil {
+				return true, err
+			}
+			var n uint64
+			n, err = r.varint()
+			lr.SeverityNumber = int(n)
+		case 3:
+			lr.SeverityText, err = r.string(field, wireType)
+		case 5:
+			lr.Body = new(otlpAnyValue)
+			err = r.embedded(field, wireType, lr.Body.unmarshalProto)
+		case 6:
+			var kv otlpKeyValue
+			err = r.embedded(field, wireType, kv.unmarshalProto)
+			lr.Attributes = append(lr.Attributes, kv)
+		case 9, 10:
+			var id string
+			if id, err = r.string(field, wireType); err == nil && id != "" {
+				id = hex.EncodeToString([]byte(id))
+			}
+			if field == 9 {
+				lr.TraceID = id
+			} else {
+				lr.SpanID = id
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (kv *otlpKeyValue) unmarshalProto(b []byte) error {
+	return kv.unmarshalProtoAt(0, b)
+}
+
+// unmarshalProtoAt decodes a key-value pair whose value is nested depth levels
+// deep in other values.
+func (kv *otlpKeyValue) unmarshalProtoAt(depth int, b []byte) error {
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		var err error
+		switch field {
+		case 1:
+			kv.Key, err = r.string(field, wireType)
+		case 2:
+			err = r.embedded(field, wireType, func(b []byte) error {
+				return kv.Value.unmarshalProtoAt(depth, b)
+			})
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (v *otlpAnyValue) unmarshalProto(b []byte) error {
+	return v.unmarshalProtoAt(0, b)
+}
+
+// unmarshalProtoAt decodes a value nested depth levels deep in other values.
+func (v *otlpAnyValue) unmarshalProtoAt(depth int, b []byte) error {
+	if depth > otlpMaxDepth {
+		return errOTLPTooDeep
+	}
+	return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+		var err error
+		switch field {
+		case 1:
+			var s string
+			s, err = r.string(field, wireType)
+			v.StringValue = &s
+		case 2, 3:
+			if err = expect(field, wireType, wireVarint); err != nil {
+				return true, err
+			}
+			var n uint64
+			n, err = r.varint()
+			if field == 2 {
+				b := n != 0
+				v.BoolValue = &b
+			} else {
+				i := otlpInt(n)
+				v.IntValue = &i
+			}
+		case 4:
+			if err = expect(field, wireType, wireFixed64); err != nil {
+				return true, err
+			}
+			var n uint64
+			n, err = r.fixed64()
+			f := math.Float64frombits(n)
+			v.DoubleValue = &f
+		case 5:
+			v.ArrayValue = new(otlpArrayValue)
+			err = r.embedded(field, wireType, func(b []byte) error {
+				return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+					if field != 1 {
+						return false, nil
+					}
+					var value otlpAnyValue
+					err := r.embedded(field, wireType, func(b []byte) error {
+						return value.unmarshalProtoAt(depth+1, b)
+					})
+					v.ArrayValue.Values = append(v.ArrayValue.Values, value)
+					return true, err
+				})
+			})
+		case 6:
+			v.KvlistValue = new(otlpKvlistValue)
+			err = r.embedded(field, wireType, func(b []byte) error {
+				return decodeMessage(b, func(r *protoReader, field, wireType int) (bool, error) {
+					if field != 1 {
+						return false, nil
+					}
+					var kv otlpKeyValue
+					err := r.embedded(field, wireType, func(b []byte) error {
+						return kv.unmarshalProtoAt(depth+1, b)
+					})
+					v.KvlistValue.Values = append(v.KvlistValue.Values, kv)
+					return true, err
+				})
+			})
+		case 7:
+			if err = expect(field, wireType, wireBytes); err != nil {
+				return true, err
+			}
+			var b []byte
+			b, err = r.bytes()
+			v.BytesValue = append([]byte{}, b...)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The proto functions encode protobuf fields for tests.
+
+func protoTag(field, wireType int) []byte {
+	return binary.AppendUvarint(nil, uint64(field<<3|wireType))
+}
+
+func protoBytes(field int, values ...[]byte) []byte {
+	b := bytes.Join(values, nil)
+	return append(binary.AppendUvarint(protoTag(field, wireBytes), uint64(len(b))), b...)
+}
+
+func protoString(field int, s string) []byte {
+	return protoBytes(field, []byte(s))
+}
+
+func protoVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(protoTag(field, wireVarint), v)
+}
+
+func protoFixed64(field int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(protoTag(field, wireFixed64), v)
+}
+
+func protoKeyValue(key string, value []byte) []byte {
+	return protoBytes(1, protoString(1, key), protoBytes(2, value))
+}
+
+func newOTLPTestApp() (*App, *ChannelLogger) {
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	return withSettings(&App{loggers: map[string]logger{"checkout": l}}, &settings{}), l
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	app, l := newOTLPTestApp()
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	record := protoBytes(2,
+		protoFixed64(1, uint64(ts.UnixNano())),
+		protoVarint(2, 17),
+		protoString(3, "ERROR"),
+		protoBytes(5, protoString(1, "payment failed")),
+		protoBytes(6,
+			protoString(1, "order.id"),
+			protoBytes(2, protoVarint(3, 42)),
+		),
+		protoBytes(6,
+			protoString(1, "retry"),
+			protoBytes(2, protoVarint(2, 1)),
+		),
+		protoBytes(6,
+			protoString(1, "amount"),
+			protoBytes(2, protoFixed64(4, math.Float64bits(9.5))),
+		),
+		protoBytes(6,
+			protoString(1, "tags"),
+			protoBytes(2, protoBytes(5, protoBytes(1, protoString(1, "a")), protoBytes(1, protoString(1, "b")))),
+		),
+		protoBytes(9, []byte{0xca, 0xfe}),
+		protoVarint(100, 1), // unknown fields are skipped
+	)
+	body := protoBytes(1,
+		protoBytes(1,
+			protoKeyValue("service.name", protoString(1, "checkout")),
+			protoKeyValue("service.instance.id", protoString(1, "web.1")),
+			protoKeyValue("host.name", protoString(1, "ip-10-0-0-1")),
+		),
+		protoBytes(2,
+			protoBytes(1, protoString(1, "io.example.payments"), protoString(2, "1.2.0")),
+			record,
+		),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Body.Bytes())
+
+	e := <-l.entries
+	assert.Equal(t, "checkout[web.1]: payment failed", e.Message)
+	assert.True(t, ts.Equal(e.Time))
+	assert.Equal(t, "ip-10-0-0-1", e.Hostname)
+	assert.Equal(t, "checkout", e.AppName)
+	assert.Equal(t, "web.1", e.ProcID)
+	assert.Equal(t, map[string]string{
+		"service.name":        "checkout",
+		"service.instance.id": "web.1",
+		"host.name":           "ip-10-0-0-1",
+		"otel.scope.name":     "io.example.payments",
+		"otel.scope.version":  "1.2.0",
+		"severity_text":       "ERROR",
+		"severity_number":     "17",
+		"trace_id":            "cafe",
+		"order.id":            "42",
+		"retry":               "true",
+		"amount":              "9.5",
+		"tags":                `["a","b"]`,
+	}, e.Attributes)
+}
+
+func TestOTLPJSON(t *testing.T) {
+	app, l := newOTLPTestApp()
+	app.settings().routes = routes{{appName: "checkout", group: "checkout"}}
+
+	body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+		"scopeLogs":[{"logRecords":[
+			{"timeUnixNano":"1682942400000000000","body":{"kvlistValue":{"values":[{"key":"event","value":{"stringValue":"paid"}}]}},
+			 "attributes":[{"key":"count","value":{"intValue":"3"}}],"traceId":"5b8efff798038103d269b633813fc60c"},
+			{"observedTimeUnixNano":1682942401000000000,"body":{"stringValue":"observed"}}
+		]}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", w.Body.String())
+
+	e := <-l.entries
+	assert.Equal(t, `checkout: {"event":"paid"}`, e.Message)
+	assert.True(t, time.Unix(1682942400, 0).Equal(e.Time))
+	assert.Equal(t, "3", e.Attributes["count"])
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", e.Attributes["trace_id"])
+
+	e = <-l.entries
+	assert.Equal(t, "checkout: observed", e.Message)
+	assert.True(t, time.Unix(1682942401, 0).Equal(e.Time))
+}
+
+func TestOTLPDefaultGroup(t *testing.T) {
+	req := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{ScopeLogs: []otlpScopeLogs{{LogRecords: []otlpLogRecord{{}}}}}}}
+	now := time.Now()
+	entries := req.entries(now)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "unknown_service", entries[0].group)
+	assert.Equal(t, now, entries[0].Time)
+	assert.Equal(t, "", entries[0].Message)
+}
+
+func TestOTLPAuthentication(t *testing.T) {
+	app, _ := newOTLPTestApp()
+	app.settings().credentials = map[string]drainCredentials{
+		"checkout": {User: "checkout", Pass: "secret"},
+		"billing":  {User: "billing", Pass: "other"},
+	}
+
+	body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},"scopeLogs":[{"logRecords":[{}]}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The body isn't decoded without valid credentials.
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader("{"))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Credentials for one log group don't allow writing to another.
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("billing", "other")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("checkout", "secret")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestOTLPInvalidRequests(t *testing.T) {
+	app, _ := newOTLPTestApp()
+
+	tests := []struct {
+		method, contentType, body string
+		status                    int
+	}{
+		{http.MethodGet, "application/json", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "application/json", "{", http.StatusBadRequest},
+		{http.MethodPost, "application/x-protobuf", "\x0a\x05abc", http.StatusBadRequest},
+		{http.MethodPost, "application/x-protobuf", "\x0b", http.StatusBadRequest},
+		{http.MethodPost, "application/x-protobuf", string(nestedProtoValue(otlpMaxDepth + 1)), http.StatusBadRequest},
+		{http.MethodPost, "application/json", nestedJSONValue(otlpMaxDepth + 1), http.StatusBadRequest},
+		{http.MethodPost, "application/x-protobuf", string(nestedProtoValue(otlpMaxDepth)), http.StatusOK},
+		{http.MethodPost, "application/json", nestedJSONValue(otlpMaxDepth), http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/v1/logs", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, test.body)
+	}
+}
+
+// nestedProtoValue returns a request with a log record whose body is an array
+// value nested depth levels deep.
+func nestedProtoValue(depth int) []byte {
+	value := protoString(1, "deep")
+	for i := 0; i < depth; i++ {
+		value = protoBytes(5, protoBytes(1, value))
+	}
+	return protoBytes(1, protoBytes(2, protoBytes(2, protoBytes(5, value))))
+}
+
+// nestedJSONValue is nestedProtoValue in JSON.
+func nestedJSONValue(depth int) string {
+	value := `{"stringValue":"deep"}`
+	for i := 0; i < depth; i++ {
+		value = `{"arrayValue":{"values":[` + value + `]}}`
+	}
+	return `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":` + value + `}]}]}]}`
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+// cloudWatchMaxMessageSize is the largest message in bytes that fits in a
+// CloudWatch Logs event, which is limited to 256 KB including 26 bytes of
+// overhead.
+const cloudWatchMaxMessageSize = 256*1024 - 26
+
+var oversizedEvents = metrics.NewCounterVec(
+	"drain_oversized_events_total",
+	"Events larger than the CloudWatch Logs event size limit, by what was done with them.",
+	"action",
+)
+
+// Policies for messages too large for a single event.
+const (
+	// oversizedSplit splits a message into numbered continuation events.
+	oversizedSplit = "split"
+	// oversizedTruncate truncates a message and marks it as truncated.
+	oversizedTruncate = "truncate"
+)
+
+// An oversizedRule sets the policy for oversized messages in the log groups
+// matching a shell pattern.
+type oversizedRule struct {
+	pattern, policy string
+}
+
+// oversizedRules is an ordered list of rules, where the first rule matching a
+// log group wins. It implements flag.Value so that rules can be given as
+// repeated flags.
+type oversizedRules []oversizedRule
+
+func (rs *oversizedRules) String() string {
+	s := make([]string, len(*rs))
+	for i, r := range *rs {
+		s[i] = r.pattern + "=" + r.policy
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses a rule in the form GROUP=POLICY, for example "batch-*=truncate".
+func (rs *oversizedRules) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("oversized event rule %q must be in the form GROUP=POLICY", value)
+	}
+	r := oversizedRule{pattern: value[:i], policy: value[i+1:]}
+	if r.policy != oversizedSplit && r.policy != oversizedTruncate {
+		return fmt.Errorf("oversized event rule %q has an unknown policy, must be %s or %s", value, oversizedSplit, oversizedTruncate)
+	}
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		return fmt.Errorf("oversized event rule %q has an invalid pattern: %s", value, err)
+	}
+	*rs = append(*rs, r)
+	return nil
+}
+
+// policy returns the policy for a log group, which is to split messages
+// unless a rule says otherwise.
+func (rs oversizedRules) policy(group string) string {
+	for _, r := range rs {
+		if matchPattern(r.pattern, group) {
+			return r.policy
+		}
+	}
+	return oversizedSplit
+}
+
+// fitMessage returns the messages to send for a message, according to the
+// policy, so that none of them is larger than max bytes.
+func fitMessage(msg string, max int, policy string) []string {
+	if len(msg) <= max {
+		return []string{msg}
+	}
+	oversizedEvents.With(policy).Inc()
+	if policy == oversizedTruncate {
+		return []string{truncateMessage(msg, max)}
+	}
+	return splitMessage(msg, max)
+}
+
+// truncateMessage truncates a message to max bytes, including a marker
+// telling how many bytes were cut off.
+func truncateMessage(msg string, max int) string {
+	// The number of bytes cut off has no more digits than the length of the
+	// message.
+	longest := len(fmt.Sprintf(" [truncated %d bytes]", len(msg)))
+	head := cutMessage(msg, max-longest)
+	return head + fmt.Sprintf(" [truncated %d bytes]", len(msg)-len(head))
+}
+
+// splitMessage splits a message into parts of at most max bytes, each
+// prefixed with its number, such as "[2/3] ".
+func splitMessage(msg string, max int) []string {
+	// Find the number of parts, taking into account that more parts need
+	// longer prefixes.
+	var size int
+	for n := 1; ; {
+		size = max - len(fmt.Sprintf("[%d/%d] ", n, n))
+		if size < 1 {
+			size = 1
+		}
+		parts := 0
+		for rest := msg; rest != ""; parts++ {
+			rest = rest[len(cutMessage(rest, size)):]
+		}
+		if parts <= n {
+			break
+		}
+		n = parts
+	}
+
+	var parts []string
+	for rest := msg; rest != ""; {
+		part := cutMessage(rest, size)
+		parts = append(parts, part)
+		rest = rest[len(part):]
+	}
+	for i, part := range parts {
+		parts[i] = fmt.Sprintf("[%d/%d] %s", i+1, len(parts), part)
+	}
+	return parts
+}
+
+// cutMessage returns the longest prefix of a message of at most max bytes
+// that doesn't cut a UTF-8 encoded character in half.
+func cutMessage(msg string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+	if len(msg) <= max {
+		return msg
+	}
+	for i := max; i > max-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(msg[i]) {
+			return msg[:i]
+		}
+	}
+	// Not valid UTF-8.
+	return msg[:max]
+}
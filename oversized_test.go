@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOversizedRules(t *testing.T) {
+	var rs oversizedRules
+	assert.NoError(t, rs.Set("batch-*=truncate"))
+	assert.NoError(t, rs.Set("*=split"))
+	assert.Equal(t, "batch-*=truncate,*=split", rs.String())
+	assert.Equal(t, oversizedTruncate, rs.policy("batch-nightly"))
+	assert.Equal(t, oversizedSplit, rs.policy("web"))
+	assert.Equal(t, oversizedSplit, oversizedRules(nil).policy("web"))
+
+	assert.EqualError(t, rs.Set("web"), `oversized event rule "web" must be in the form GROUP=POLICY`)
+	assert.EqualError(t, rs.Set("web=drop"), `oversized event rule "web=drop" has an unknown policy, must be split or truncate`)
+	assert.EqualError(t, rs.Set("[=split"), `oversized event rule "[=split" has an invalid pattern: syntax error in pattern`)
+}
+
+func TestFitMessage(t *testing.T) {
+	assert.Equal(t, []string{"short"}, fitMessage("short", 10, oversizedSplit))
+	assert.Equal(t, []string{"0123456789"}, fitMessage("0123456789", 10, oversizedTruncate))
+
+	count := oversizedEvents.With(oversizedTruncate).Value()
+	msg := strings.Repeat("a", 100)
+	parts := fitMessage(msg, 40, oversizedTruncate)
+	assert.Equal(t, []string{strings.Repeat("a", 18) + " [truncated 82 bytes]"}, parts)
+	assert.Equal(t, int64(1), oversizedEvents.With(oversizedTruncate).Value()-count)
+}
+
+func TestSplitMessage(t *testing.T) {
+	parts := splitMessage("0123456789abcdefghij", 12)
+	assert.Equal(t, []string{"[1/4] 012345", "[2/4] 6789ab", "[3/4] cdefgh", "[4/4] ij"}, parts)
+
+	// More parts need longer prefixes.
+	msg := strings.Repeat("x", 60)
+	parts = splitMessage(msg, 12)
+	assert.Len(t, parts, 15)
+	assert.Equal(t, "[1/15] xxxx", parts[0])
+	assert.Equal(t, "[15/15] xxxx", parts[14])
+	var joined string
+	for _, part := range parts {
+		assert.True(t, len(part) <= 12, part)
+		joined += part[strings.Index(part, " ")+1:]
+	}
+	assert.Equal(t, msg, joined)
+}
+
+func TestSplitMessageUTF8(t *testing.T) {
+	msg := strings.Repeat("ä", 10) // 2 bytes each
+	parts := splitMessage(msg, 11)
+	for _, part := range parts {
+		assert.True(t, len(part) <= 11, part)
+		assert.True(t, utf8.ValidString(part), part)
+	}
+	assert.Equal(t, []string{"[1/5] ää", "[2/5] ää", "[3/5] ää", "[4/5] ää", "[5/5] ää"}, parts)
+
+	assert.Equal(t, "ää [truncated 16 bytes]", truncateMessage(msg, 25))
+}
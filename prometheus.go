@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+// metricsPath is the path of the Prometheus endpoint.
+const metricsPath = "/metrics"
+
+var requestsTotal = metrics.NewCounterVec(
+	"drain_requests_total",
+	"HTTP requests received, by response status and log group.",
+	"status", "group",
+)
+
+var framesTotal = metrics.NewCounterVec(
+	"drain_frames_total",
+	"Logplex frames received by HTTPS drains, by whether they could be parsed.",
+	"result",
+)
+
+var activeLoggers = metrics.NewGaugeVec(
+	"drain_active_loggers",
+	"Log groups with loggers open in all the sinks.",
+)
+
+// registry holds the metrics served on the Prometheus endpoint.
+var registry = metrics.NewRegistry(
+	requestsTotal,
+	requestBytesReceived,
+	requestBytesDecoded,
+	requestsTooLarge,
+	framesTotal,
+	authFailures,
+	syslogDropped,
+	timestampsOutOfRange,
+	activeLoggers,
+	eventsSent,
+	eventsDropped,
+	queueDepth,
+	sinkThrottled,
+	oversizedEvents,
+	putLogEventsDuration,
+	configReloads,
+	logGroupChanges,
+)
+
+// serveMetrics serves the metrics in the Prometheus text format, behind basic
+// auth if a metrics user or password is set.
+func (app *App) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s := app.settings()
+	if (s.metricsUser != "" || s.metricsPass != "") && !app.requireBasicAuth(w, r, "metrics", s.metricsUser, s.metricsPass) {
+		return
+	}
+	registry.ServeHTTP(w, r)
+}
+
+// otherGroup is the log group label of requests that weren't authenticated
+// for a single log group, so that clients can't make up new series by choosing
+// the path. It includes OTLP requests, which may carry several log groups, and
+// admin API requests.
+const otherGroup = "other"
+
+// A statusRecorder records the status code of a response, and the log group
+// the request was authenticated for.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	group  string
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// countAs counts a request under a log group in the requests metric, once it
+// has been authenticated for it.
+func countAs(w http.ResponseWriter, group string) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.group = group
+	}
+}
+
+// metricsGroup returns the log group the request is counted under in the
+// requests metric.
+func (w *statusRecorder) metricsGroup() string {
+	if w.group == "" {
+		return otherGroup
+	}
+	return w.group
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	app := &App{loggers: map[string]logger{"metrics-test": new(LastMessageLogger)}, parse: logparser.Parse}
+	accepted := requestsTotal.With("202", "metrics-test").Value()
+	parsed := framesTotal.With("parsed").Value()
+	failed := framesTotal.With("failed").Value()
+
+	body := "89 <45>1 2016-10-15T08:59:08.723822+00:00 host heroku web.1 - State changed from up to down"
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics-test", strings.NewReader(body)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics-test", strings.NewReader("not syslog")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	assert.Equal(t, int64(1), requestsTotal.With("202", "metrics-test").Value()-accepted)
+	assert.Equal(t, int64(1), framesTotal.With("parsed").Value()-parsed)
+	assert.Equal(t, int64(1), framesTotal.With("failed").Value()-failed)
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE drain_requests_total counter\n")
+	assert.Contains(t, w.Body.String(), `drain_requests_total{status="202",group="metrics-test"} `)
+	assert.Contains(t, w.Body.String(), "# TYPE drain_cloudwatch_put_log_events_duration_seconds histogram\n")
+}
+
+func TestMetricsAuthentication(t *testing.T) {
+	app := withSettings(&App{loggers: map[string]logger{}}, &settings{metricsUser: "prometheus", metricsPass: "secret"})
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("prometheus", "secret")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequestGroup(t *testing.T) {
+	app := withSettings(&App{loggers: map[string]logger{"app": new(LastMessageLogger)}, parse: logparser.Parse}, &settings{
+		credentials: map[string]drainCredentials{"app": {User: "app", Pass: "secret"}},
+	})
+
+	tests := []struct {
+		method, path string
+		auth         bool
+		group        string
+	}{
+		{http.MethodPost, "/app", true, "app"},
+		{http.MethodPost, "/_json/app", true, "app"},
+		{http.MethodPost, "/app", false, otherGroup},
+		{http.MethodPost, "/made-up", true, otherGroup},
+		{http.MethodPost, "/_json/made-up", false, otherGroup},
+		// OTLP requests may carry several log groups.
+		{http.MethodPost, "/v1/logs", true, otherGroup},
+		{http.MethodPost, "/_admin/loggers/flush", false, otherGroup},
+		{http.MethodGet, "/anything", false, otherGroup},
+	}
+	const otlpBody = `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"app"}}]},"scopeLogs":[{"logRecords":[{}]}]}]}`
+	for _, test := range tests {
+		counts := make(map[int]int64)
+		for status := 200; status < 600; status++ {
+			counts[status] = requestsTotal.With(strconv.Itoa(status), test.group).Value()
+		}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(otlpBody))
+		r.Header.Set("Content-Type", "application/json")
+		if test.auth {
+			r.SetBasicAuth("app", "secret")
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assert.Equal(t, int64(1), requestsTotal.With(strconv.Itoa(w.Code), test.group).Value()-counts[w.Code], test.path)
+	}
+}
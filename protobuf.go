@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protobuf: unexpected end of message")
+
+// A protoReader reads messages in the protocol buffers wire format field by
+// field. It only supports what is needed to decode OTLP requests, which saves
+// vendoring a protobuf library and the generated OTLP code.
+type protoReader struct {
+	b []byte
+}
+
+// next reads the tag of the next field. It returns false at the end of the
+// message.
+func (r *protoReader) next() (field int, wireType int, ok bool, err error) {
+	if len(r.b) == 0 {
+		return 0, 0, false, nil
+	}
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	field, wireType = int(tag>>3), int(tag&7)
+	if field == 0 {
+		return 0, 0, false, errors.New("protobuf: invalid field number 0")
+	}
+	return field, wireType, true, nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.b) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, nil
+}
+
+func (r *protoReader) fixed32() (uint32, error) {
+	if len(r.b) < 4 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, nil
+}
+
+// bytes reads a length-delimited field: a string, bytes, or an embedded
+// message.
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// skip skips the value of a field that isn't needed.
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed32()
+	default:
+		err = fmt.Errorf("protobuf: unsupported wire type %d", wireType)
+	}
+	return err
+}
+
+// expect returns an error if a field doesn't have the wire type its number
+// calls for.
+func expect(field, wireType, expected int) error {
+	if wireType != expected {
+		return fmt.Errorf("protobuf: field %d has wire type %d, expected %d", field, wireType, expected)
+	}
+	return nil
+}
+
+// decodeMessage calls fn for each field of a message. Fields that fn doesn't
+// handle are skipped.
+func decodeMessage(b []byte, fn func(r *protoReader, field, wireType int) (bool, error)) error {
+	r := &protoReader{b: b}
+	for {
+		field, wireType, ok, err := r.next()
+		if err != nil || !ok {
+			return err
+		}
+		handled, err := fn(r, field, wireType)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// embedded reads an embedded message field and decodes it with unmarshal.
+func (r *protoReader) embedded(field, wireType int, unmarshal func(b []byte) error) error {
+	if err := expect(field, wireType, wireBytes); err != nil {
+		return err
+	}
+	b, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	return unmarshal(b)
+}
+
+// string reads a string field.
+func (r *protoReader) string(field, wireType int) (string, error) {
+	if err := expect(field, wireType, wireBytes); err != nil {
+		return "", err
+	}
+	b, err := r.bytes()
+	return string(b), err
+}
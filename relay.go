@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// Logplex sends at most this many frames, and this many bytes, per request.
+const (
+	relayMaxFrames = 500
+	relayMaxBytes  = 1024 * 1024
+)
+
+// relayMaxAttempts is the number of times a batch is sent before it is
+// dropped.
+const relayMaxAttempts = 5
+
+// relaySink forwards entries to other HTTPS drains, such as Papertrail or
+// another instance of this drain, as octet-counted Logplex frames. Each drain
+// gets a queue of its own, so that a slow drain doesn't hold up the others.
+//
+// The drain URLs may contain a {group} placeholder, which is replaced with the
+// log group.
+type relaySink struct {
+	urls      []string
+	interval  time.Duration
+	queueSize int
+	client    *http.Client
+}
+
+func newRelaySink(c *sinkConfig) (sink, error) {
+	if len(c.relayURLs) == 0 {
+		return nil, errors.New("no drain URLs given")
+	}
+	if c.relayFlushInterval <= 0 {
+		return nil, errors.New("the flush interval must be positive")
+	}
+	for _, u := range c.relayURLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "https" && parsed.Scheme != "http" {
+			return nil, fmt.Errorf("drain URL %s must be http or https", parsed.Redacted())
+		}
+	}
+	return &relaySink{
+		urls:      c.relayURLs,
+		interval:  c.relayFlushInterval,
+		queueSize: c.queueSize,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *relaySink) logger(group string) (logger, error) {
+	f := make(fanoutLogger, 0, len(s.urls))
+	for _, u := range s.urls {
+		d := &relayDrain{
+			client: s.client,
+			url:    strings.Replace(u, "{group}", url.PathEscape(group), -1),
+		}
+		l := newBatchLogger("relay", relayMaxFrames, relayMaxBytes, s.interval, encodeFrame, d.post)
+		// A batch logger posts a full batch, with retries, before it takes
+		// the next entry. Without a queue of its own, a drain that is down
+		// would hold up the queue in front of the relay sink, and with it
+		// every other drain. The entries are counted under "relay" when they
+		// leave that queue, and under "relay_drain" when they leave the queue
+		// of a drain, so drops under "relay_drain" are those of a slow drain.
+		f = append(f, newQueuedLogger("relay_drain", l, s.queueSize))
+	}
+	return f, nil
+}
+
+// encodeFrame returns the entry as an octet-counted frame. Entries that didn't
+// come from syslog get a syslog header made up from their fields.
+func encodeFrame(e *logparser.LogEntry) (batchItem, error) {
+	msg := e.Raw
+	if msg == nil {
+		text := strings.TrimPrefix(e.Message, e.AppName+"["+e.ProcID+"]: ")
+		msg = []byte(fmt.Sprintf("<14>1 %s %s %s %s - %s",
+			e.Time.UTC().Format(time.RFC3339Nano), syslogField(e.Hostname), syslogField(e.AppName), syslogField(e.ProcID), text))
+	}
+	msg = bytes.TrimSuffix(msg, []byte("\n"))
+
+	frame := make([]byte, 0, len(msg)+8)
+	frame = strconv.AppendInt(frame, int64(len(msg)+1), 10)
+	frame = append(frame, ' ')
+	frame = append(frame, msg...)
+	frame = append(frame, '\n')
+	return batchItem{data: frame}, nil
+}
+
+// syslogField returns the NILVALUE for empty syslog header fields.
+func syslogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// A relayDrain is a downstream drain for a single log group.
+type relayDrain struct {
+	client *http.Client
+	url    string
+}
+
+// post sends the frames in a single request, the same way Logplex does.
+func (d *relayDrain) post(items []batchItem) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.data)
+	}
+
+	err := retry(relayMaxAttempts, func() error {
+		return d.send(body.Bytes(), len(items))
+	})
+	if err != nil {
+		eventsDropped.With("relay").Add(int64(len(items)))
+		err = fmt.Errorf("relay: failed to send %d frames to %s: %s", len(items), redactURL(d.url), err)
+		healthOf("relay").fail()
+		honeybadger.Notify(err)
+		log.Println(err)
+		return
+	}
+	healthOf("relay").succeed()
+}
+
+func (d *relayDrain) send(body []byte, count int) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/logplex-1")
+	req.Header.Set("Logplex-Msg-Count", strconv.Itoa(count))
+	req.Header.Set("Logplex-Frame-Id", newFrameID())
+	req.Header.Set("User-Agent", "heroku-cloudwatch-drain")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		// Network errors are always worth retrying.
+		return errors.New(redactURL(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			sinkThrottled.With("relay").Inc()
+		}
+		return &relayError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// newFrameID returns a random ID for the Logplex-Frame-Id header.
+func newFrameID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var userinfoRegexp = regexp.MustCompile(`(//[^/:@\s]+):[^/@\s]*@`)
+
+// redactURL hides any passwords in URLs in s.
+func redactURL(s string) string {
+	return userinfoRegexp.ReplaceAllString(s, "$1:xxxxx@")
+}
+
+// A relayError is an error response from a downstream drain.
+type relayError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *relayError) Error() string {
+	return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *relayError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// urlList is a flag.Value for a repeatable URL flag.
+type urlList []string
+
+func (l *urlList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *urlList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
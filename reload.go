@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+var configReloads = metrics.NewCounterVec(
+	"drain_config_reloads_total",
+	"Attempts to reload the configuration, by whether the new configuration was valid.",
+	"result",
+)
+
+// watchConfig reloads the configuration when the process receives SIGHUP, and
+// when the configuration file or the credentials file changes. The files are
+// checked for changes every interval, unless it is zero. It never returns.
+func (app *App) watchConfig(name string, args []string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	stamps := statConfigFiles(app.settings().options)
+	for {
+		select {
+		case <-hup:
+			log.Println("reloading the configuration after SIGHUP")
+		case <-tick:
+			s := statConfigFiles(app.settings().options)
+			if s == stamps {
+				continue
+			}
+			log.Println("reloading the configuration after a file changed")
+		}
+		app.reloadConfig(name, args)
+		stamps = statConfigFiles(app.settings().options)
+	}
+}
+
+// A fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// configStamps identify the versions of the configuration and credentials
+// files.
+type configStamps struct {
+	config, credentials fileStamp
+}
+
+func statConfigFiles(o *options) configStamps {
+	var stamps configStamps
+	if o == nil {
+		return stamps
+	}
+	for path, stamp := range map[string]*fileStamp{o.config: &stamps.config, o.credentialsFile: &stamps.credentials} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			*stamp = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
+
+// reloadConfig parses the command line arguments again, along with the
+// configuration and credentials files, and switches to the new settings. The
+// current settings are kept if the new ones are invalid.
+func (app *App) reloadConfig(name string, args []string) {
+	o, err := parseOptions(name, args, flag.ContinueOnError)
+	if err == nil {
+		err = app.reload(o)
+	}
+	if err != nil {
+		configReloads.With("failure").Inc()
+		err = fmt.Errorf("failed to reload the configuration: %s", err)
+		honeybadger.Notify(err)
+		log.Println(err)
+		return
+	}
+	configReloads.With("success").Inc()
+}
+
+// reload switches to the settings made from the options. Requests and
+// connections pick up the new settings as a whole from then on. If the sinks
+// are configured differently, the open loggers are retired, and entries go to
+// new loggers. Otherwise, if the settings of log groups changed, the sinks are
+// given them, and they are applied to the log groups of the open loggers.
+func (app *App) reload(o *options) error {
+	prev := app.settings()
+	s, err := newSettings(o, prev)
+	if err != nil {
+		return err
+	}
+	groupsChanged := !sinksChanged(prev.options, o) && logGroupsChanged(prev.options, o)
+	if groupsChanged {
+		setLogGroups(s.sinks, &o.sink)
+	}
+	app.current.Store(s)
+
+	if prev.options != nil {
+		if flags := restartRequired(prev.options, o); len(flags) > 0 {
+			log.Printf("changes to %s take effect after a restart\n", strings.Join(flags, ", "))
+		}
+	}
+	retired := 0
+	if sinksChanged(prev.options, o) {
+		retired = app.retireLoggers()
+	} else if groupsChanged {
+		groups := app.groups()
+		reconcileLogGroups(s.sinks, groups)
+		log.Printf("applied the log group settings to %d log groups\n", len(groups))
+	}
+	log.Printf("reloaded the configuration, retired %d loggers\n", retired)
+	return nil
+}
+
+// groups returns the log groups with open loggers, sorted by name.
+func (app *App) groups() []string {
+	app.mu.Lock()
+	groups := make([]string, 0, len(app.loggers))
+	for group := range app.loggers {
+		groups = append(groups, group)
+	}
+	app.mu.Unlock()
+	sort.Strings(groups)
+	return groups
+}
+
+// retireLoggers closes all the open loggers in the background, after they
+// have written out the entries they have, and returns how many there were.
+// Entries that arrive from then on are written with new loggers.
+func (app *App) retireLoggers() int {
+	app.replacing.Lock()
+	app.mu.Lock()
+	retired := app.loggers
+	app.loggers = make(map[string]logger)
+	atomic.AddInt64(&app.generation, 1)
+	activeLoggers.With().Add(-int64(len(retired)))
+	app.retiring.Add(len(retired))
+	app.mu.Unlock()
+	app.replacing.Unlock()
+
+	for _, l := range retired {
+		go func(l logger) {
+			l.Close()
+			app.retiring.Done()
+		}(l)
+	}
+	return len(retired)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newReloadTestApp(t *testing.T, args []string) *App {
+	o, err := parseOptions("drain", args, flag.ContinueOnError)
+	assert.NoError(t, err)
+	s, err := newSettings(o, nil)
+	assert.NoError(t, err)
+	return withSettings(&App{loggers: make(map[string]logger)}, s)
+}
+
+func TestReload(t *testing.T) {
+	path := writeConfig(t, "sinks:\n  enabled: [stdout]\n")
+	args := []string{"-config", path, "-user", "me"}
+	app := newReloadTestApp(t, args)
+	before := app.settings()
+	l, err := app.logger("web")
+	assert.NoError(t, err)
+
+	// Changing the routes and credentials keeps the loggers.
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+auth:
+  user: ignored
+  pass: secret
+routes:
+  - match: heroku/router
+    group: "{group}/router"
+sinks:
+  enabled: [stdout]
+`), 0600))
+	app.reloadConfig("drain", args)
+	s := app.settings()
+	assert.Equal(t, "heroku/router={group}/router", s.routes.String())
+	assert.Equal(t, "me", s.user)
+	assert.Equal(t, "secret", s.pass)
+	assert.Equal(t, before.sinks, s.sinks)
+	assert.Equal(t, before.authLimiter, s.authLimiter)
+	same, err := app.logger("web")
+	assert.NoError(t, err)
+	assert.Equal(t, l, same)
+
+	// Changing a sink retires the loggers.
+	gen := app.generation
+	assert.NoError(t, ioutil.WriteFile(path, []byte("sinks:\n  enabled: [stdout]\n  color: true\n"), 0600))
+	app.reloadConfig("drain", args)
+	app.retiring.Wait()
+	assert.True(t, app.settings().options.sink.streamColor)
+	assert.Empty(t, app.loggers)
+	assert.Equal(t, gen+1, app.generation)
+	assert.True(t, l.(fanoutLogger)[0].(*queuedLogger).closed)
+}
+
+// CountingLogger counts the entries it is given.
+type CountingLogger struct {
+	count int64
+}
+
+func (l *CountingLogger) Log(e *logparser.LogEntry) {
+	atomic.AddInt64(&l.count, 1)
+}
+
+func (l *CountingLogger) Close() {}
+
+func TestRetireLoggersWhileWriting(t *testing.T) {
+	const entries = 20000
+	counting := new(CountingLogger)
+	app := withSettings(&App{loggers: make(map[string]logger)}, &settings{
+		sinks:     []namedSink{{"reload-race", &testSink{l: counting}}},
+		queueSize: entries,
+	})
+	dropped := eventsDropped.With("reload-race").Value()
+
+	const writers = 8
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			w := app.newEntryWriter()
+			for i := 0; i < entries/writers; i++ {
+				assert.NoError(t, w.write("app", &logparser.LogEntry{Message: "entry"}))
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for retiring := true; retiring; {
+		select {
+		case <-done:
+			retiring = false
+		default:
+			app.retireLoggers()
+		}
+	}
+	app.Stop()
+
+	// Entries logged while loggers are retired go to the new ones.
+	assert.Equal(t, int64(entries), atomic.LoadInt64(&counting.count))
+	assert.Equal(t, dropped, eventsDropped.With("reload-race").Value())
+}
+
+func TestReloadLogGroups(t *testing.T) {
+	path := writeConfig(t, "sinks:\n  enabled: [stdout]\n")
+	args := []string{"-config", path}
+	app := newReloadTestApp(t, args)
+	before := app.settings()
+	l, err := app.logger("web")
+	assert.NoError(t, err)
+
+	// Changing only the settings of log groups keeps the sinks and loggers.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("sinks:\n  enabled: [stdout]\n  cloudwatch:\n    retention: 7\n"), 0600))
+	app.reloadConfig("drain", args)
+	assert.Equal(t, 7, app.settings().options.sink.retention)
+	assert.Equal(t, before.sinks, app.settings().sinks)
+	same, err := app.logger("web")
+	assert.NoError(t, err)
+	assert.Equal(t, l, same)
+}
+
+func TestReloadInvalid(t *testing.T) {
+	path := writeConfig(t, "sinks:\n  enabled: [stdout]\n")
+	args := []string{"-config", path}
+	app := newReloadTestApp(t, args)
+	before := app.settings()
+	failures := configReloads.With("failure").Value()
+
+	for _, config := range []string{
+		"sinks:\n  enabled: [stdout]\n  colour: true\n",
+		"sinks:\n  enabled: [stdout]\nroutes:\n  - match: x\n",
+		"sinks:\n  enabled: [stdout\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+		app.reloadConfig("drain", args)
+		assert.Equal(t, before, app.settings(), config)
+	}
+	assert.Equal(t, failures+3, configReloads.With("failure").Value())
+}
+
+func TestRestartRequired(t *testing.T) {
+	old, err := parseOptions("drain", []string{"-syslog-rule", "10.0.0.0/8=internal"}, flag.ContinueOnError)
+	assert.NoError(t, err)
+	o, err := parseOptions("drain", []string{"-bind", ":9000", "-syslog-rule", "10.0.0.0/8=internal", "-user", "me"}, flag.ContinueOnError)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-bind"}, restartRequired(old, o))
+	assert.Empty(t, restartRequired(o, o))
+}
+
+func TestStatConfigFiles(t *testing.T) {
+	path := writeConfig(t, "routes: []\n")
+	o := &options{config: path}
+	stamps := statConfigFiles(o)
+	assert.Equal(t, stamps, statConfigFiles(o))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("routes: []\nsinks: {}\n"), 0600))
+	assert.NotEqual(t, stamps, statConfigFiles(o))
+	assert.Equal(t, configStamps{}, statConfigFiles(nil))
+}
+
+func TestSinksChanged(t *testing.T) {
+	o := &options{sinkNames: "stdout", queueSize: 10, sink: sinkConfig{fileFormat: "ndjson"}}
+	same := *o
+	assert.True(t, sinksChanged(nil, o))
+	assert.False(t, sinksChanged(o, &same))
+
+	other := *o
+	other.sink.relayURLs = urlList{"https://example.com"}
+	assert.True(t, sinksChanged(o, &other))
+
+	other = *o
+	other.queueSize = 20
+	assert.True(t, sinksChanged(o, &other))
+
+	o.sink.fileMaxAge = time.Hour
+	assert.True(t, sinksChanged(o, &same))
+}
+
+func TestLogGroupsChanged(t *testing.T) {
+	o := &options{sinkNames: "cloudwatch", sink: sinkConfig{retention: 30}}
+	same := *o
+	assert.True(t, logGroupsChanged(nil, o))
+	assert.False(t, logGroupsChanged(o, &same))
+
+	// Log group settings are applied without retiring loggers.
+	other := *o
+	other.sink.retention = 7
+	other.sink.logGroups = logGroupRules{{pattern: "prod-*", logGroupSettings: logGroupSettings{kmsKey: "arn:aws:kms:key"}}}
+	assert.True(t, logGroupsChanged(o, &other))
+	assert.False(t, sinksChanged(o, &other))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// A route sends log entries with a matching APP-NAME and PROCID to a log group
+// other than the one the drain was posted to.
+type route struct {
+	// appName and procID are shell patterns as understood by path.Match. An
+	// empty pattern matches anything.
+	appName, procID string
+
+	// group is the name of the log group matching entries are sent to. The
+	// placeholder {group} is replaced with the log group of the drain.
+	group string
+}
+
+// parseRoute parses a route in the form APP-NAME[/PROCID]=GROUP, for example
+// "heroku/router={group}/router".
+func parseRoute(s string) (route, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return route{}, fmt.Errorf("route %q must be in the form APP-NAME[/PROCID]=GROUP", s)
+	}
+	rt := route{group: s[i+1:]}
+	if rt.group == "" {
+		return route{}, fmt.Errorf("route %q has no log group", s)
+	}
+
+	match := s[:i]
+	if j := strings.Index(match, "/"); j >= 0 {
+		rt.appName, rt.procID = match[:j], match[j+1:]
+	} else {
+		rt.appName = match
+	}
+	for _, pattern := range []string{rt.appName, rt.procID} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return route{}, fmt.Errorf("route %q has an invalid pattern: %s", s, err)
+		}
+	}
+	return rt, nil
+}
+
+func (rt route) match(e *logparser.LogEntry) bool {
+	return matchPattern(rt.appName, e.AppName) && matchPattern(rt.procID, e.ProcID)
+}
+
+func (rt route) String() string {
+	s := rt.appName
+	if rt.procID != "" {
+		s += "/" + rt.procID
+	}
+	return s + "=" + rt.group
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// routes is an ordered list of routes, where the first matching route wins.
+// It implements flag.Value so that routes can be given as repeated flags.
+type routes []route
+
+func (rs *routes) String() string {
+	s := make([]string, len(*rs))
+	for i, rt := range *rs {
+		s[i] = rt.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (rs *routes) Set(value string) error {
+	rt, err := parseRoute(value)
+	if err != nil {
+		return err
+	}
+	*rs = append(*rs, rt)
+	return nil
+}
+
+// group returns the log group an entry posted to the given log group should
+// be sent to.
+func (rs routes) group(group string, e *logparser.LogEntry) string {
+	for _, rt := range rs {
+		if rt.match(e) {
+			return strings.Replace(rt.group, "{group}", group, -1)
+		}
+	}
+	return group
+}
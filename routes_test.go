@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+	rt, err := parseRoute("heroku/router={group}/router")
+	assert.NoError(t, err)
+	assert.Equal(t, route{appName: "heroku", procID: "router", group: "{group}/router"}, rt)
+
+	rt, err = parseRoute("app=app-logs")
+	assert.NoError(t, err)
+	assert.Equal(t, route{appName: "app", group: "app-logs"}, rt)
+
+	rt, err = parseRoute("/heroku-postgres={group}/postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, route{procID: "heroku-postgres", group: "{group}/postgres"}, rt)
+
+	for _, s := range []string{"heroku/router", "heroku/router=", "[/router=x"} {
+		_, err = parseRoute(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRoutesGroup(t *testing.T) {
+	var rs routes
+	assert.NoError(t, rs.Set("heroku/router={group}/router"))
+	assert.NoError(t, rs.Set("app/heroku-postgres*={group}/postgres"))
+	assert.NoError(t, rs.Set("heroku=platform"))
+	assert.Equal(t, "heroku/router={group}/router,app/heroku-postgres*={group}/postgres,heroku=platform", rs.String())
+
+	tests := []struct {
+		appName, procID, group string
+	}{
+		{"heroku", "router", "my-app/router"},
+		{"app", "heroku-postgres", "my-app/postgres"},
+		{"heroku", "web.1", "platform"},
+		{"app", "web.1", "my-app"},
+	}
+
+	for _, test := range tests {
+		e := &logparser.LogEntry{AppName: test.appName, ProcID: test.procID}
+		assert.Equal(t, test.group, rs.group("my-app", e), "%+v", test)
+	}
+}
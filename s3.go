@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeybadger-io/honeybadger-go"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// s3MinPartSize is the minimum size of all but the last part of a multipart
+// upload.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// s3Sink archives log groups to S3 as gzip compressed NDJSON objects. Objects
+// are partitioned Hive style by log group, and by the date and hour of the
+// entries in them:
+//
+//	<prefix>group=<group>/dt=2017-10-15/hour=08/<time>-<id>.ndjson.gz
+//
+// An object is written for each partition, and rolled over once it reaches the
+// maximum size or age. Objects larger than the part size are uploaded with a
+// multipart upload as they are being written.
+type s3Sink struct {
+	client    *awsClient
+	bucket    string
+	prefix    string
+	pathStyle bool
+	maxSize   int64
+	maxAge    time.Duration
+	partSize  int
+}
+
+func newS3Sink(c *sinkConfig) (sink, error) {
+	if c.s3Bucket == "" {
+		return nil, errors.New("no bucket given")
+	}
+	if c.s3MaxObjectSize <= 0 {
+		return nil, errors.New("the maximum object size must be positive")
+	}
+	if c.s3MaxObjectAge < time.Second {
+		return nil, errors.New("the maximum object age must be at least 1s")
+	}
+	region, creds, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Sink{
+		bucket:   c.s3Bucket,
+		prefix:   c.s3Prefix,
+		maxSize:  c.s3MaxObjectSize,
+		maxAge:   c.s3MaxObjectAge,
+		partSize: s3MinPartSize,
+	}
+
+	// Custom endpoints, such as S3 compatible stand-ins, are addressed with
+	// the bucket in the path. AWS itself is addressed with the bucket in the
+	// host name.
+	endpoint := c.s3Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + c.s3Bucket + ".s3." + region + ".amazonaws.com"
+	} else {
+		s.pathStyle = true
+	}
+
+	if s.client, err = newAWSClient("s3", region, endpoint, creds); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *s3Sink) logger(group string) (logger, error) {
+	l := &s3Logger{
+		sink:    s,
+		group:   group,
+		objects: make(map[string]*s3Object),
+		done:    make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.rollover()
+	return l, nil
+}
+
+// key returns the key for a new object in the partition.
+func (s *s3Sink) key(partition string) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return fmt.Sprintf("%s%s/%d-%s.ndjson.gz", s.prefix, partition, time.Now().UnixNano()/int64(time.Millisecond), hex.EncodeToString(id))
+}
+
+func (s *s3Sink) path(key string) string {
+	if s.pathStyle {
+		return "/" + s.bucket + "/" + key
+	}
+	return "/" + key
+}
+
+func (s *s3Sink) putObject(key string, body []byte) error {
+	header := http.Header{"Content-Type": {"application/gzip"}}
+	return retry(3, func() error {
+		_, _, err := s.client.do(http.MethodPut, s.path(key), nil, header, body)
+		return err
+	})
+}
+
+func (s *s3Sink) createMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := retry(3, func() error {
+		b, _, err := s.client.do(http.MethodPost, s.path(key), url.Values{"uploads": {""}}, http.Header{"Content-Type": {"application/gzip"}}, nil)
+		if err != nil {
+			return err
+		}
+		return xml.Unmarshal(b, &result)
+	})
+	return result.UploadID, err
+}
+
+func (s *s3Sink) uploadPart(key, uploadID string, number int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	var etag string
+	err := retry(3, func() error {
+		_, header, err := s.client.do(http.MethodPut, s.path(key), query, nil, body)
+		if err != nil {
+			return err
+		}
+		etag = header.Get("ETag")
+		return nil
+	})
+	return etag, err
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Sink) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return retry(3, func() error {
+		b, _, err := s.client.do(http.MethodPost, s.path(key), url.Values{"uploadId": {uploadID}}, nil, body)
+		if err != nil {
+			return err
+		}
+		// The request can fail after S3 has already responded with 200 OK,
+		// in which case the error is in the response body.
+		if bytes.Contains(b, []byte("<Error>")) {
+			return newAWSError(http.StatusInternalServerError, b)
+		}
+		return nil
+	})
+}
+
+func (s *s3Sink) abortMultipartUpload(key, uploadID string) error {
+	_, _, err := s.client.do(http.MethodDelete, s.path(key), url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+// An s3Logger writes a log group to S3.
+type s3Logger struct {
+	sink  *s3Sink
+	group string
+
+	mu      sync.Mutex
+	objects map[string]*s3Object // by partition
+	errors  int64                // accessed atomically
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (l *s3Logger) Log(e *logparser.LogEntry) {
+	b, err := json.Marshal(newJSONEntry(l.group, e))
+	if err != nil {
+		honeybadger.Notify(err)
+		eventsDropped.With("s3").Inc()
+		return
+	}
+	b = append(b, '\n')
+
+	t := e.Time.UTC()
+	partition := fmt.Sprintf("group=%s/dt=%s/hour=%02d", url.PathEscape(l.group), t.Format("2006-01-02"), t.Hour())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	o, ok := l.objects[partition]
+	if !ok {
+		o = newS3Object(l.sink.key(partition))
+		l.objects[partition] = o
+	}
+	if err := l.write(o, b); err != nil {
+		l.fail(partition, o, err)
+		return
+	}
+	if o.size() >= l.sink.maxSize {
+		l.finish(partition, o)
+	}
+}
+
+// Flush uploads all the objects that are open.
+func (l *s3Logger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for partition, o := range l.objects {
+		l.finish(partition, o)
+	}
+}
+
+// Close uploads all the objects that are still open.
+func (l *s3Logger) Close() {
+	close(l.done)
+	l.wg.Wait()
+	l.Flush()
+}
+
+func (l *s3Logger) errorCount() int64 {
+	return atomic.LoadInt64(&l.errors)
+}
+
+// rollover periodically uploads the objects that have reached their maximum
+// age.
+func (l *s3Logger) rollover() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.sink.maxAge / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			for partition, o := range l.objects {
+				if time.Since(o.created) >= l.sink.maxAge {
+					l.finish(partition, o)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// write adds a line to the object, and uploads the compressed data written so
+// far as a part once there is enough of it. Must be called with l.mu held.
+func (l *s3Logger) write(o *s3Object, b []byte) error {
+	if _, err := o.gz.Write(b); err != nil {
+		return err
+	}
+	o.entries++
+	if o.buf.Len() < l.sink.partSize {
+		return nil
+	}
+	if o.uploadID == "" {
+		id, err := l.sink.createMultipartUpload(o.key)
+		if err != nil {
+			return err
+		}
+		o.uploadID = id
+	}
+	return l.uploadPart(o)
+}
+
+func (l *s3Logger) uploadPart(o *s3Object) error {
+	number := len(o.parts) + 1
+	etag, err := l.sink.uploadPart(o.key, o.uploadID, number, o.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	o.parts = append(o.parts, s3Part{PartNumber: number, ETag: etag})
+	o.uploaded += int64(o.buf.Len())
+	o.buf.Reset()
+	return nil
+}
+
+// finish completes the upload of an object. Must be called with l.mu held.
+func (l *s3Logger) finish(partition string, o *s3Object) {
+	delete(l.objects, partition)
+	if err := o.gz.Close(); err != nil {
+		l.fail(partition, o, err)
+		return
+	}
+
+	var err error
+	if o.uploadID == "" {
+		err = l.sink.putObject(o.key, o.buf.Bytes())
+	} else if err = l.uploadPart(o); err == nil {
+		err = l.sink.completeMultipartUpload(o.key, o.uploadID, o.parts)
+	}
+	if err != nil {
+		l.fail(partition, o, err)
+		return
+	}
+	healthOf("s3").succeed()
+}
+
+// fail discards an object that couldn't be uploaded. Must be called with l.mu
+// held.
+func (l *s3Logger) fail(partition string, o *s3Object, err error) {
+	delete(l.objects, partition)
+	if o.uploadID != "" {
+		if err := l.sink.abortMultipartUpload(o.key, o.uploadID); err != nil {
+			log.Printf("s3: failed to abort upload of %s: %s\n", o.key, err)
+		}
+	}
+	eventsDropped.With("s3").Add(int64(o.entries))
+	atomic.AddInt64(&l.errors, 1)
+	err = fmt.Errorf("s3: failed to upload %s: %s", o.key, err)
+	healthOf("s3").fail()
+	honeybadger.Notify(err)
+	log.Println(err)
+}
+
+// An s3Object is an object that is being written to S3.
+type s3Object struct {
+	key     string
+	created time.Time
+	entries int
+
+	buf bytes.Buffer // compressed data that hasn't been uploaded yet
+	gz  *gzip.Writer
+
+	uploadID string // set once a multipart upload has been started
+	parts    []s3Part
+	uploaded int64
+}
+
+func newS3Object(key string) *s3Object {
+	o := &s3Object{key: key, created: time.Now()}
+	o.gz = gzip.NewWriter(&o.buf)
+	return o
+}
+
+// size returns the compressed size of the object so far.
+func (o *s3Object) size() int64 {
+	return o.uploaded + int64(o.buf.Len())
+}
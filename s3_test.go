@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeS3 is a minimal stand-in for S3, supporting the requests made by the s3
+// sink.
+type FakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	fail    bool
+}
+
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (s *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if s.fail {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<Error><Code>InvalidRequest</Code><Message>nope</Message></Error>`)
+		return
+	}
+
+	key := r.URL.Path
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		id := fmt.Sprintf("upload-%d", len(s.uploads))
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		var n int
+		fmt.Sscan(q.Get("partNumber"), &n)
+		s.uploads[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		var complete struct {
+			Parts []s3Part `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var object []byte
+		for _, p := range complete.Parts {
+			object = append(object, s.uploads[q.Get("uploadId")][p.PartNumber]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(s.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Objects returns the keys of all the objects, sorted.
+func (s *FakeS3) Objects() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Lines returns the decompressed lines of an object.
+func (s *FakeS3) Lines(t *testing.T, key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gz, err := gzip.NewReader(bytes.NewReader(s.objects[key]))
+	assert.NoError(t, err)
+	var lines []string
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func newTestS3Sink(t *testing.T, endpoint string) *s3Sink {
+	client, err := newAWSClient("s3", "us-east-1", endpoint, credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	assert.NoError(t, err)
+	return &s3Sink{
+		client:    client,
+		bucket:    "logs",
+		prefix:    "drain/",
+		pathStyle: true,
+		maxSize:   1024 * 1024 * 1024,
+		maxAge:    time.Hour,
+		partSize:  s3MinPartSize,
+	}
+}
+
+func TestNewS3SinkInvalidLimits(t *testing.T) {
+	for _, c := range []sinkConfig{
+		{s3Bucket: "logs", s3MaxObjectSize: 0, s3MaxObjectAge: time.Minute},
+		{s3Bucket: "logs", s3MaxObjectSize: 1024, s3MaxObjectAge: 0},
+		{s3Bucket: "logs", s3MaxObjectSize: 1024, s3MaxObjectAge: time.Nanosecond},
+	} {
+		_, err := newS3Sink(&c)
+		assert.Error(t, err, "%+v", c)
+	}
+}
+
+func TestS3SinkPartitions(t *testing.T) {
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := newTestS3Sink(t, server.URL).logger("my-app/router")
+	assert.NoError(t, err)
+
+	l.Log(&logparser.LogEntry{Time: time.Date(2017, 10, 15, 8, 59, 0, 0, time.UTC), Message: "one", AppName: "heroku", ProcID: "router"})
+	l.Log(&logparser.LogEntry{Time: time.Date(2017, 10, 15, 8, 59, 30, 0, time.UTC), Message: "two"})
+	l.Log(&logparser.LogEntry{Time: time.Date(2017, 10, 15, 9, 0, 0, 0, time.UTC), Message: "three"})
+	l.Close()
+
+	keys := fake.Objects()
+	assert.Len(t, keys, 2)
+	assert.True(t, strings.HasPrefix(keys[0], "/logs/drain/group=my-app%2Frouter/dt=2017-10-15/hour=08/"), keys[0])
+	assert.True(t, strings.HasPrefix(keys[1], "/logs/drain/group=my-app%2Frouter/dt=2017-10-15/hour=09/"), keys[1])
+	assert.True(t, strings.HasSuffix(keys[0], ".ndjson.gz"))
+
+	lines := fake.Lines(t, keys[0])
+	assert.Len(t, lines, 2)
+	var entry jsonEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, jsonEntry{
+		Time:    time.Date(2017, 10, 15, 8, 59, 0, 0, time.UTC),
+		Group:   "my-app/router",
+		Message: "one",
+		AppName: "heroku",
+		ProcID:  "router",
+	}, entry)
+	assert.Len(t, fake.Lines(t, keys[1]), 1)
+}
+
+func TestS3SinkMultipartUpload(t *testing.T) {
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestS3Sink(t, server.URL)
+	s.partSize = 1024
+	s.maxSize = 4096
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+
+	// Random messages, so that they don't compress too well.
+	now := time.Now()
+	for i := 0; i < 2000; i++ {
+		l.Log(&logparser.LogEntry{Time: now, Message: fmt.Sprintf("%d %x%x%x%x", i, rand.Int63(), rand.Int63(), rand.Int63(), rand.Int63())})
+	}
+	l.Close()
+
+	total := 0
+	for _, key := range fake.Objects() {
+		total += len(fake.Lines(t, key))
+	}
+	assert.Equal(t, 2000, total)
+	assert.True(t, len(fake.Objects()) > 1, "expected the object to be rolled over")
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3SinkRolloverByAge(t *testing.T) {
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestS3Sink(t, server.URL)
+	s.maxAge = 50 * time.Millisecond
+	l, err := s.logger("app")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	assert.Empty(t, fake.Objects())
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, fake.Objects(), 1)
+}
+
+func TestS3SinkFailure(t *testing.T) {
+	fake := NewFakeS3()
+	fake.fail = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := newTestS3Sink(t, server.URL).logger("app")
+	assert.NoError(t, err)
+
+	before := eventsDropped.With("s3").Value()
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "hello"})
+	l.Close()
+
+	assert.Empty(t, fake.Objects())
+	assert.Equal(t, before+1, eventsDropped.With("s3").Value())
+}
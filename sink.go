@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+var eventsDropped = metrics.NewCounterVec(
+	"drain_events_dropped_total",
+	"Log entries dropped by a sink, because its queue was full or it failed to write them.",
+	"sink",
+)
+
+var eventsSent = metrics.NewCounterVec(
+	"drain_events_sent_total",
+	"Log entries passed from the queue of a sink to its logger.",
+	"sink",
+)
+
+var queueDepth = metrics.NewGaugeVec(
+	"drain_queue_depth",
+	"Log entries waiting in the queues of a sink, across all log groups.",
+	"sink",
+)
+
+var sinkThrottled = metrics.NewCounterVec(
+	"drain_sink_throttled_total",
+	"Requests or records rejected by the destination of a sink because of rate limits.",
+	"sink",
+)
+
+// A logger writes the entries of a single log group to a destination.
+//
+// Entries passed to Log may be shared with other loggers, and must not be
+// modified.
+type logger interface {
+	Log(e *logparser.LogEntry)
+	Close()
+}
+
+// A flusher is a logger that buffers entries, and can be asked to write them
+// out right away.
+type flusher interface {
+	Flush()
+}
+
+// An errorCounter is a logger that counts the errors it had writing entries.
+type errorCounter interface {
+	errorCount() int64
+}
+
+// A sink is a destination for log entries, such as CloudWatch Logs. It creates
+// a logger for each log group written to it.
+type sink interface {
+	logger(group string) (logger, error)
+}
+
+// A reconciler is a sink that keeps settings for the log groups at its
+// destination, such as their retention, and can bring an existing log group
+// in line with them. The settings can be replaced while the sink is in use.
+type reconciler interface {
+	reconcile(group string) error
+	setLogGroups(retention int, rules logGroupRules)
+}
+
+// sinkTypes holds the constructors for the sinks that can be enabled with the
+// -sink flag, by name.
+var sinkTypes = map[string]func(c *sinkConfig) (sink, error){
+	"cloudwatch": newCloudWatchSink,
+	"s3":         newS3Sink,
+	"kinesis":    newKinesisSink,
+	"firehose":   newFirehoseSink,
+	"file":       newFileSink,
+	"stdout":     newStdoutSink,
+	"stderr":     newStderrSink,
+	"opensearch": newOpenSearchSink,
+	"relay":      newRelaySink,
+}
+
+// sinkConfig holds the settings for all the sink types.
+type sinkConfig struct {
+	queueSize  int
+	retention  int
+	logGroups  logGroupRules
+	oversized  oversizedRules
+	timestamps timestampPolicy
+
+	s3Bucket        string
+	s3Prefix        string
+	s3Endpoint      string
+	s3MaxObjectSize int64
+	s3MaxObjectAge  time.Duration
+
+	kinesisStream        string
+	kinesisEndpoint      string
+	firehoseStream       string
+	firehoseEndpoint     string
+	kinesisFlushInterval time.Duration
+
+	fileDir      string
+	fileFormat   string
+	fileMaxSize  int64
+	fileMaxAge   time.Duration
+	fileMaxFiles int
+	fileCompress bool
+
+	streamColor bool
+
+	openSearchURL           string
+	openSearchIndexPrefix   string
+	openSearchFlushInterval time.Duration
+
+	relayURLs          urlList
+	relayFlushInterval time.Duration
+}
+
+// namedSink is a sink along with the name it was enabled with.
+type namedSink struct {
+	name string
+	sink
+}
+
+// newSinks creates the sinks in the comma separated list of names.
+func newSinks(names string, c *sinkConfig) ([]namedSink, error) {
+	var sinks []namedSink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		newSink, ok := sinkTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sink %q, available sinks: %s", name, strings.Join(sinkNames(), ", "))
+		}
+		s, err := newSink(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s sink: %s", name, err)
+		}
+		sinks = append(sinks, namedSink{name: name, sink: s})
+	}
+	return sinks, nil
+}
+
+func sinkNames() []string {
+	names := make([]string, 0, len(sinkTypes))
+	for name := range sinkTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFanoutLogger creates a logger for the log group in each of the sinks, and
+// returns a logger that writes every entry to all of them. Each sink gets its
+// own queue, so that a slow or failing sink doesn't hold up the others.
+func newFanoutLogger(group string, sinks []namedSink, queueSize int) (logger, error) {
+	f := make(fanoutLogger, 0, len(sinks))
+	for _, s := range sinks {
+		l, err := s.logger(group)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", s.name, err)
+		}
+		f = append(f, newQueuedLogger(s.name, l, queueSize))
+	}
+	return f, nil
+}
+
+// A fanoutLogger writes entries to several loggers.
+type fanoutLogger []logger
+
+func (f fanoutLogger) Log(e *logparser.LogEntry) {
+	for _, l := range f {
+		l.Log(e)
+	}
+}
+
+// Flush flushes all the loggers that can be flushed in parallel.
+func (f fanoutLogger) Flush() {
+	var wg sync.WaitGroup
+	for _, l := range f {
+		if l, ok := l.(flusher); ok {
+			wg.Add(1)
+			go func(l flusher) {
+				l.Flush()
+				wg.Done()
+			}(l)
+		}
+	}
+	wg.Wait()
+}
+
+// Close closes all the loggers in parallel.
+func (f fanoutLogger) Close() {
+	var wg sync.WaitGroup
+	wg.Add(len(f))
+	for _, l := range f {
+		go func(l logger) {
+			l.Close()
+			wg.Done()
+		}(l)
+	}
+	wg.Wait()
+}
+
+// A queuedLogger passes entries on to a logger from a goroutine of its own,
+// through a bounded queue. Entries are dropped when the queue is full, or once
+// the logger is closed.
+type queuedLogger struct {
+	sink  string
+	l     logger
+	queue chan *logparser.LogEntry // a nil entry asks for a flush
+	done  chan struct{}
+
+	mu     sync.RWMutex // protects closed, and sending to queue
+	closed bool
+
+	flushMu sync.Mutex // serializes flushes
+	flushed chan struct{}
+
+	depth *metrics.Gauge
+	sent  *metrics.Counter
+
+	lastWrite int64 // Unix time in nanoseconds, accessed atomically
+	dropped   int64 // accessed atomically
+}
+
+func newQueuedLogger(sink string, l logger, size int) *queuedLogger {
+	q := &queuedLogger{
+		sink:    sink,
+		l:       l,
+		queue:   make(chan *logparser.LogEntry, size),
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+		depth:   queueDepth.With(sink),
+		sent:    eventsSent.With(sink),
+	}
+	go q.worker()
+	return q
+}
+
+func (q *queuedLogger) Log(e *logparser.LogEntry) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.closed {
+		q.depth.Inc()
+		select {
+		case q.queue <- e:
+			return
+		default:
+			q.depth.Dec()
+		}
+	}
+	atomic.AddInt64(&q.dropped, 1)
+	eventsDropped.With(q.sink).Inc()
+}
+
+// Flush waits for the entries queued so far to be passed on, and flushes the
+// underlying logger if it buffers entries.
+func (q *queuedLogger) Flush() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return
+	}
+	q.queue <- nil
+	q.mu.RUnlock()
+	<-q.flushed
+}
+
+// Close waits for the queue to drain, and closes the underlying logger.
+func (q *queuedLogger) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+	<-q.done
+	q.l.Close()
+}
+
+func (q *queuedLogger) worker() {
+	for e := range q.queue {
+		if e == nil {
+			if f, ok := q.l.(flusher); ok {
+				f.Flush()
+			}
+			q.flushed <- struct{}{}
+			continue
+		}
+		q.depth.Dec()
+		q.l.Log(e)
+		q.sent.Inc()
+		atomic.StoreInt64(&q.lastWrite, time.Now().UnixNano())
+	}
+	close(q.done)
+}
+
+// A queueStats describes the state of the queue of a sink for a log group.
+type queueStats struct {
+	Sink      string     `json:"sink"`
+	Queued    int        `json:"queued"`
+	QueueSize int        `json:"queue_size"`
+	Dropped   int64      `json:"dropped"`
+	Errors    *int64     `json:"errors,omitempty"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+}
+
+func (q *queuedLogger) stats() queueStats {
+	s := queueStats{
+		Sink:      q.sink,
+		Queued:    len(q.queue),
+		QueueSize: cap(q.queue),
+		Dropped:   atomic.LoadInt64(&q.dropped),
+	}
+	if c, ok := q.l.(errorCounter); ok {
+		n := c.errorCount()
+		s.Errors = &n
+	}
+	if n := atomic.LoadInt64(&q.lastWrite); n != 0 {
+		t := time.Unix(0, n).UTC()
+		s.LastWrite = &t
+	}
+	return s
+}
+
+// retryBackoff is the time to wait before the first retry of a failed request
+// to a sink. It is doubled after every attempt.
+var retryBackoff = 500 * time.Millisecond
+
+// retry calls fn until it succeeds or the attempts run out, backing off
+// exponentially between attempts. Errors that have a Temporary method
+// returning false are returned right away.
+func retry(attempts int, fn func() error) (err error) {
+	wait := retryBackoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if t, ok := err.(interface {
+			Temporary() bool
+		}); ok && !t.Temporary() {
+			return err
+		}
+	}
+	return err
+}
+
+// A jsonEntry is the JSON representation of a log entry, used by sinks that
+// write JSON documents.
+type jsonEntry struct {
+	Time     time.Time `json:"time"`
+	Group    string    `json:"group"`
+	Message  string    `json:"message"`
+	Hostname string    `json:"hostname,omitempty"`
+	AppName  string    `json:"app_name,omitempty"`
+	ProcID   string    `json:"proc_id,omitempty"`
+
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func newJSONEntry(group string, e *logparser.LogEntry) *jsonEntry {
+	return &jsonEntry{
+		Time:     e.Time,
+		Group:    group,
+		Message:  e.Message,
+		Hostname: e.Hostname,
+		AppName:  e.AppName,
+		ProcID:   e.ProcID,
+
+		Attributes: e.Attributes,
+	}
+}
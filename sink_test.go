@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ChannelLogger sends every entry it receives to a channel.
+type ChannelLogger struct {
+	entries chan *logparser.LogEntry
+	closed  bool
+}
+
+func (l *ChannelLogger) Log(e *logparser.LogEntry) {
+	l.entries <- e
+}
+
+func (l *ChannelLogger) Close() {
+	l.closed = true
+}
+
+type testSink struct {
+	l   logger
+	err error
+}
+
+func (s *testSink) logger(group string) (logger, error) {
+	return s.l, s.err
+}
+
+func TestFanoutLogger(t *testing.T) {
+	a := &ChannelLogger{entries: make(chan *logparser.LogEntry, 1)}
+	b := &ChannelLogger{entries: make(chan *logparser.LogEntry, 1)}
+	sinks := []namedSink{{"a", &testSink{l: a}}, {"b", &testSink{l: b}}}
+
+	l, err := newFanoutLogger("app", sinks, 10)
+	assert.NoError(t, err)
+
+	e := &logparser.LogEntry{Time: time.Now(), Message: "hello"}
+	l.Log(e)
+	l.Close()
+
+	assert.Equal(t, e, <-a.entries)
+	assert.Equal(t, e, <-b.entries)
+	assert.True(t, a.closed)
+	assert.True(t, b.closed)
+}
+
+func TestFanoutLoggerError(t *testing.T) {
+	a := &ChannelLogger{}
+	sinks := []namedSink{{"a", &testSink{l: a}}, {"b", &testSink{err: errors.New("failed")}}}
+
+	_, err := newFanoutLogger("app", sinks, 10)
+	assert.EqualError(t, err, "b: failed")
+	assert.True(t, a.closed)
+}
+
+// BlockingLogger blocks in Log until released.
+type BlockingLogger struct {
+	started chan bool
+	release chan bool
+}
+
+func (l *BlockingLogger) Log(e *logparser.LogEntry) {
+	l.started <- true
+	<-l.release
+}
+
+func (l *BlockingLogger) Close() {}
+
+func TestQueuedLoggerDropsWhenFull(t *testing.T) {
+	blocked := &BlockingLogger{started: make(chan bool), release: make(chan bool)}
+	q := newQueuedLogger("slow", blocked, 1)
+	before := eventsDropped.With("slow").Value()
+	sent := eventsSent.With("slow").Value()
+
+	// The first entry is picked up by the worker, which then blocks. The second
+	// one fills the queue, and the third one is dropped.
+	q.Log(&logparser.LogEntry{Message: "1"})
+	<-blocked.started
+	q.Log(&logparser.LogEntry{Message: "2"})
+	q.Log(&logparser.LogEntry{Message: "3"})
+
+	assert.Equal(t, before+1, eventsDropped.With("slow").Value())
+	assert.Equal(t, int64(1), queueDepth.With("slow").Value())
+
+	close(blocked.release)
+	go func() {
+		for range blocked.started {
+		}
+	}()
+	q.Close()
+	assert.Equal(t, int64(0), queueDepth.With("slow").Value())
+	assert.Equal(t, sent+2, eventsSent.With("slow").Value())
+}
+
+func TestNewSinksUnknown(t *testing.T) {
+	_, err := newSinks("cloudwatch,nope", &sinkConfig{})
+	assert.Error(t, err)
+}
+
+func TestQueuedLoggerFlush(t *testing.T) {
+	r := new(BatchRecorder)
+	b := newBatchLogger("test", 100, 1000, time.Hour, encodeMessage, r.Flush)
+	q := newQueuedLogger("flush", b, 10)
+	defer q.Close()
+
+	q.Log(&logparser.LogEntry{Message: "a"})
+	q.Log(&logparser.LogEntry{Message: "b"})
+	q.Flush()
+	assert.Equal(t, []int{2}, r.Sizes())
+}
+
+func TestQueuedLoggerAfterClose(t *testing.T) {
+	l := &ChannelLogger{entries: make(chan *logparser.LogEntry, 1)}
+	q := newQueuedLogger("closed", l, 1)
+	q.Close()
+	q.Close()
+	assert.True(t, l.closed)
+
+	before := eventsDropped.With("closed").Value()
+	q.Log(&logparser.LogEntry{Message: "late"})
+	q.Flush()
+	assert.Equal(t, before+1, eventsDropped.With("closed").Value())
+	assert.Equal(t, int64(1), q.stats().Dropped)
+}
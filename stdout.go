@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+)
+
+// dynoColors are the ANSI colors used for the APP-NAME[PROCID] prefixes of
+// messages when colors are enabled.
+var dynoColors = []string{"\x1b[36m", "\x1b[33m", "\x1b[32m", "\x1b[35m", "\x1b[34m", "\x1b[31m", "\x1b[96m", "\x1b[93m", "\x1b[92m", "\x1b[95m"}
+
+// streamSink prints entries to standard output or standard error, one line
+// per entry, in the form:
+//
+//	2016-10-15T08:59:08.723822Z my-app heroku[web.1]: State changed from up to down
+//
+// It doesn't need AWS, which makes it handy for trying out the drain locally.
+type streamSink struct {
+	name  string
+	color bool
+
+	mu sync.Mutex // protects w, which is shared by all log groups
+	w  io.Writer
+}
+
+func newStdoutSink(c *sinkConfig) (sink, error) {
+	return &streamSink{name: "stdout", w: os.Stdout, color: c.streamColor}, nil
+}
+
+func newStderrSink(c *sinkConfig) (sink, error) {
+	return &streamSink{name: "stderr", w: os.Stderr, color: c.streamColor}, nil
+}
+
+func (s *streamSink) logger(group string) (logger, error) {
+	return &streamLogger{sink: s, group: group}, nil
+}
+
+type streamLogger struct {
+	sink  *streamSink
+	group string
+}
+
+func (l *streamLogger) Log(e *logparser.LogEntry) {
+	var buf bytes.Buffer
+	buf.WriteString(e.Time.UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(' ')
+	buf.WriteString(l.group)
+	buf.WriteByte(' ')
+
+	prefix := e.AppName + "[" + e.ProcID + "]:"
+	if l.sink.color && e.AppName != "" && strings.HasPrefix(e.Message, prefix) {
+		buf.WriteString(dynoColor(e.AppName, e.ProcID))
+		buf.WriteString(prefix)
+		buf.WriteString("\x1b[0m")
+		buf.WriteString(e.Message[len(prefix):])
+	} else {
+		buf.WriteString(e.Message)
+	}
+	buf.WriteByte('\n')
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	if _, err := l.sink.w.Write(buf.Bytes()); err != nil {
+		eventsDropped.With(l.sink.name).Inc()
+	}
+}
+
+func (l *streamLogger) Close() {}
+
+// dynoColor returns the color for a dyno, which is the same every time.
+func dynoColor(appName, procID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(appName + "[" + procID + "]"))
+	return dynoColors[h.Sum32()%uint32(len(dynoColors))]
+}
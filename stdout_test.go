@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := &streamSink{w: &buf}
+	l, err := s.logger("my-app")
+	assert.NoError(t, err)
+
+	l.Log(&logparser.LogEntry{
+		Time:    time.Date(2016, 10, 15, 8, 59, 8, 723822000, time.UTC),
+		Message: "heroku[web.1]: State changed from up to down",
+		AppName: "heroku",
+		ProcID:  "web.1",
+	})
+	assert.Equal(t, "2016-10-15T08:59:08.723822Z my-app heroku[web.1]: State changed from up to down\n", buf.String())
+}
+
+func TestStreamSinkColor(t *testing.T) {
+	var buf bytes.Buffer
+	s := &streamSink{w: &buf, color: true}
+	l, err := s.logger("my-app")
+	assert.NoError(t, err)
+
+	e := &logparser.LogEntry{
+		Time:    time.Date(2016, 10, 15, 8, 59, 8, 0, time.UTC),
+		Message: "app[web.1]: Started GET /",
+		AppName: "app",
+		ProcID:  "web.1",
+	}
+	l.Log(e)
+	l.Log(e)
+
+	line := "2016-10-15T08:59:08Z my-app " + dynoColor("app", "web.1") + "app[web.1]:\x1b[0m Started GET /\n"
+	assert.Equal(t, line+line, buf.String())
+	assert.Equal(t, "2016-10-15T08:59:08Z my-app app[web.1]: Started GET /\n", stripAnsi(line))
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+// syslogMaxFrameLength is the maximum length of a syslog message received over
+// TCP. RFC 5425 only requires 2048 bytes, but recommends 8192 or more.
+const syslogMaxFrameLength = 64 * 1024
+
+// syslogIdleTimeout is how long a TCP or TLS connection may go without sending
+// anything before it is closed. Syslog clients reconnect when they have
+// something to send.
+var syslogIdleTimeout = 10 * time.Minute
+
+var syslogDropped = metrics.NewCounterVec(
+	"drain_syslog_dropped_total",
+	"Syslog messages dropped because they were malformed or had no log group.",
+	"listener", "reason",
+)
+
+// A syslogInput passes syslog messages received by a listener on to the
+// loggers of their log groups.
+//
+// The log group of a message is the group of the first rule matching the
+// message, or else the default group. If groupParam is set, the group parameter
+// of the structured data of a message, e.g. [meta@32473 group="my-app/web"],
+// can pick that group or a group below it instead. Messages are then routed the
+// same way as messages received over HTTPS.
+type syslogInput struct {
+	app        *App
+	name       string
+	rules      syslogRules
+	group      string
+	groupParam bool
+}
+
+// log parses a message from the given address and writes it. It returns an
+// error if the logger for the message can't be created. Messages that are
+// dropped are counted, but aren't errors.
+func (in *syslogInput) log(w *entryWriter, frame []byte, ip net.IP) error {
+	if len(bytes.TrimSpace(frame)) == 0 {
+		return nil
+	}
+	entry, err := logparser.ParseSyslog(frame)
+	if err != nil {
+		syslogDropped.With(in.name, "malformed").Inc()
+		return nil
+	}
+	group := in.rules.group(entry, ip, in.group, in.groupParam)
+	if group == "" {
+		syslogDropped.With(in.name, "no_group").Inc()
+		return nil
+	}
+	return w.write(group, entry)
+}
+
+// A syslogListener receives syslog messages over TCP or TLS, framed either with
+// octet counting (RFC 5425, RFC 6587) or with newlines (RFC 6587).
+type syslogListener struct {
+	syslogInput
+	l net.Listener
+
+	mu     sync.Mutex // protects conns and closed
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// listenSyslog starts accepting connections from l. The name is used in metrics
+// and errors.
+func (app *App) listenSyslog(name string, l net.Listener, rules syslogRules, group string, groupParam bool) *syslogListener {
+	s := &syslogListener{
+		syslogInput: syslogInput{app: app, name: name, rules: rules, group: group, groupParam: groupParam},
+		l:           l,
+		conns:       make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops accepting connections, closes the open ones, and waits for the
+// messages already received to be passed on.
+func (s *syslogListener) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.l.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *syslogListener) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Printf("syslog %s: %s", s.name, err)
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *syslogListener) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	w := s.app.newEntryWriter()
+	r := bufio.NewReaderSize(conn, syslogMaxFrameLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(syslogIdleTimeout))
+		frame, err := readSyslogFrame(r)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Printf("syslog %s: closing idle connection from %s", s.name, conn.RemoteAddr())
+			return
+		}
+		if err == nil {
+			err = s.log(w, frame, ip)
+		} else if err != io.EOF {
+			syslogDropped.With(s.name, "malformed").Inc()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("syslog %s: closing connection from %s: %s", s.name, conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// A syslogPacketListener receives syslog messages as UDP datagrams (RFC 5426),
+// one message per datagram.
+type syslogPacketListener struct {
+	syslogInput
+	conn net.PacketConn
+	done chan struct{}
+}
+
+// listenSyslogPackets starts reading datagrams from conn. The name is used in
+// metrics and errors.
+func (app *App) listenSyslogPackets(name string, conn net.PacketConn, rules syslogRules, group string, groupParam bool) *syslogPacketListener {
+	s := &syslogPacketListener{
+		syslogInput: syslogInput{app: app, name: name, rules: rules, group: group, groupParam: groupParam},
+		conn:        conn,
+		done:        make(chan struct{}),
+	}
+	go s.serve()
+	return s
+}
+
+// Close stops reading datagrams, and waits for the ones already read to be
+// passed on.
+func (s *syslogPacketListener) Close() {
+	s.conn.Close()
+	<-s.done
+}
+
+func (s *syslogPacketListener) serve() {
+	defer close(s.done)
+	w := s.app.newEntryWriter()
+	buf := make([]byte, syslogMaxFrameLength)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		var ip net.IP
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			ip = udp.IP
+		}
+		// The parsed entry keeps a reference to the message, so it can't stay
+		// in the buffer.
+		frame := append([]byte(nil), buf[:n]...)
+		if err := s.log(w, frame, ip); err != nil {
+			syslogDropped.With(s.name, "no_logger").Inc()
+			log.Printf("syslog %s: %s", s.name, err)
+		}
+	}
+}
+
+// A syslogRule maps syslog messages from a source address or with a hostname
+// to a log group.
+type syslogRule struct {
+	// Exactly one of network and hostname is set. hostname is a shell pattern
+	// as understood by path.Match.
+	network  *net.IPNet
+	hostname string
+
+	group string
+}
+
+// parseSyslogRule parses a rule in the form MATCH=GROUP, where MATCH is an IP
+// address, a CIDR block such as 10.0.0.0/8, or a hostname pattern such as
+// router-*.
+func parseSyslogRule(s string) (syslogRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return syslogRule{}, fmt.Errorf("syslog rule %q must be in the form ADDRESS=GROUP or HOSTNAME=GROUP", s)
+	}
+	match, rule := s[:i], syslogRule{group: s[i+1:]}
+
+	if _, network, err := net.ParseCIDR(match); err == nil {
+		rule.network = network
+	} else if ip := net.ParseIP(match); ip != nil {
+		bits := 8 * len(ip.To4())
+		if bits == 0 {
+			bits = 8 * net.IPv6len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		if _, err := path.Match(match, ""); err != nil {
+			return syslogRule{}, fmt.Errorf("syslog rule %q has an invalid pattern: %s", s, err)
+		}
+		rule.hostname = match
+	}
+	return rule, nil
+}
+
+func (r syslogRule) match(e *logparser.LogEntry, ip net.IP) bool {
+	if r.network != nil {
+		return ip != nil && r.network.Contains(ip)
+	}
+	return matchPattern(r.hostname, e.Hostname)
+}
+
+func (r syslogRule) String() string {
+	if r.network != nil {
+		return r.network.String() + "=" + r.group
+	}
+	return r.hostname + "=" + r.group
+}
+
+// syslogRules is an ordered list of rules, where the first matching rule wins.
+// It implements flag.Value so that rules can be given as repeated flags.
+type syslogRules []syslogRule
+
+func (rs *syslogRules) String() string {
+	s := make([]string, len(*rs))
+	for i, r := range *rs {
+		s[i] = r.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (rs *syslogRules) Set(s string) error {
+	r, err := parseSyslogRule(s)
+	if err != nil {
+		return err
+	}
+	*rs = append(*rs, r)
+	return nil
+}
+
+// group returns the log group for an entry received from the given address:
+// the group of the first matching rule, or else the default group. If
+// groupParam is set, the group parameter of the structured data of the entry
+// is used instead, as long as it is that group or a group below it. The
+// listeners have no passwords, so a client can't write to other log groups
+// than the ones its rule allows.
+func (rs syslogRules) group(e *logparser.LogEntry, ip net.IP, group string, groupParam bool) string {
+	for _, r := range rs {
+		if r.match(e, ip) {
+			group = r.group
+			break
+		}
+	}
+	if !groupParam || group == "" {
+		return group
+	}
+	for _, params := range e.StructuredData {
+		if g := params["group"]; g != "" {
+			if g == group || strings.HasPrefix(g, group+"/") {
+				return g
+			}
+			break
+		}
+	}
+	return group
+}
+
+// readSyslogFrame reads a single message. Messages starting with a digit are
+// taken to be octet counted, and the rest to be terminated by a newline.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] < '0' || b[0] > '9' {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("message longer than %d bytes", syslogMaxFrameLength)
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		return append([]byte(nil), line...), nil
+	}
+
+	count, err := r.ReadSlice(' ')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errors.New("invalid octet count")
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(count[:len(count)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid octet count %q", count)
+	}
+	if n > syslogMaxFrameLength {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d bytes", n, syslogMaxFrameLength)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// newSyslogTLSConfig returns the TLS configuration for the syslog listener. If
+// a CA file is given, clients must present a certificate signed by it.
+func newSyslogTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
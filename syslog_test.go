@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogListener(t *testing.T) {
+	def := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	other := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := &App{loggers: map[string]logger{"default": def, "default/other": other}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := app.listenSyslog("tcp", ln, nil, "default", true)
+	defer s.Close()
+
+	malformed := syslogDropped.With("tcp", "malformed").Value()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	io.WriteString(conn, "83 <40>1 2012-11-30T06:45:29+00:00 host app web.3 - State changed from starting to up\n")
+	io.WriteString(conn, "<34>1 - - su 1234 - [meta group=\"default/other\"] 'su root' failed\n")
+	io.WriteString(conn, "not syslog\n")
+	io.WriteString(conn, "<34>1 - - su 1234 - - no newline")
+	conn.Close()
+
+	assert.Equal(t, "app[web.3]: State changed from starting to up", (<-def.entries).Message)
+	assert.Equal(t, "su[1234]: 'su root' failed", (<-other.entries).Message)
+	assert.Equal(t, "su[1234]: no newline", (<-def.entries).Message)
+	assert.Equal(t, malformed+1, syslogDropped.With("tcp", "malformed").Value())
+}
+
+func TestSyslogPacketListener(t *testing.T) {
+	vms := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	routers := &ChannelLogger{entries: make(chan *logparser.LogEntry, 10)}
+	app := &App{loggers: map[string]logger{"vms": vms, "routers": routers}}
+
+	var rules syslogRules
+	assert.NoError(t, rules.Set("router-*=routers"))
+	assert.NoError(t, rules.Set("127.0.0.0/8=vms"))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := app.listenSyslogPackets("udp", conn, rules, "", false)
+	defer s.Close()
+
+	malformed := syslogDropped.With("udp", "malformed").Value()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	io.WriteString(client, "garbage")
+	io.WriteString(client, "<34>1 - router-1 ospfd - - - neighbor down")
+	io.WriteString(client, "<34>1 - vm-1 cron 42 - - job done")
+
+	assert.Equal(t, "ospfd: neighbor down", (<-routers.entries).Message)
+	assert.Equal(t, "cron[42]: job done", (<-vms.entries).Message)
+	assert.Equal(t, malformed+1, syslogDropped.With("udp", "malformed").Value())
+}
+
+func TestSyslogRules(t *testing.T) {
+	var rules syslogRules
+	for _, r := range []string{"10.1.2.3=host", "10.0.0.0/8=network", "fd00::/8=ipv6", "web-*=web"} {
+		assert.NoError(t, rules.Set(r))
+	}
+	assert.Equal(t, "10.1.2.3/32=host,10.0.0.0/8=network,fd00::/8=ipv6,web-*=web", rules.String())
+
+	tests := []struct {
+		ip       string
+		hostname string
+		sd       map[string]map[string]string
+		expected string
+	}{
+		{"10.1.2.3", "", nil, "host"},
+		{"10.1.2.4", "web-1", nil, "network"},
+		{"fd00::1", "", nil, "ipv6"},
+		{"192.168.0.1", "web-1", nil, "web"},
+		{"192.168.0.1", "db-1", nil, "default"},
+		{"10.1.2.3", "", map[string]map[string]string{"meta": {"group": "host/sd"}}, "host"},
+	}
+	for _, test := range tests {
+		e := &logparser.LogEntry{Hostname: test.hostname, StructuredData: test.sd}
+		assert.Equal(t, test.expected, rules.group(e, net.ParseIP(test.ip), "default", false), test.ip)
+	}
+
+	// With groupParam, messages can only pick the group of their rule or a
+	// group below it.
+	for _, test := range []struct {
+		ip, group, expected string
+	}{
+		{"10.1.2.3", "host/sd", "host/sd"},
+		{"10.1.2.3", "host", "host"},
+		{"10.1.2.3", "hostile", "host"},
+		{"10.1.2.3", "other", "host"},
+		{"192.168.0.1", "default/sd", "default/sd"},
+	} {
+		e := &logparser.LogEntry{StructuredData: map[string]map[string]string{"meta": {"group": test.group}}}
+		assert.Equal(t, test.expected, rules.group(e, net.ParseIP(test.ip), "default", true), "%+v", test)
+	}
+	e := &logparser.LogEntry{StructuredData: map[string]map[string]string{"meta": {"group": "sd"}}}
+	assert.Equal(t, "", syslogRules(nil).group(e, nil, "", true))
+}
+
+func TestInvalidSyslogRules(t *testing.T) {
+	var rules syslogRules
+	for _, r := range []string{"", "10.0.0.0/8", "=group", "10.0.0.0/8=", "[=group"} {
+		assert.Error(t, rules.Set(r), r)
+	}
+}
+
+func TestSyslogListenerIdleTimeout(t *testing.T) {
+	syslogIdleTimeout = 50 * time.Millisecond
+	defer func() { syslogIdleTimeout = 10 * time.Minute }()
+	app := &App{loggers: map[string]logger{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := app.listenSyslog("tcp", ln, nil, "default", false)
+	defer s.Close()
+
+	malformed := syslogDropped.With("tcp", "malformed").Value()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "the connection should have been closed")
+	assert.Equal(t, malformed, syslogDropped.With("tcp", "malformed").Value())
+}
+
+func TestSyslogListenerClose(t *testing.T) {
+	app := &App{loggers: map[string]logger{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := app.listenSyslog("tcp", ln, nil, "default", false)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return with a connection open")
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader("5 hello\n11 hello world<1>1 newline\n<2>1 eof"), syslogMaxFrameLength)
+	for _, expected := range []string{"hello", "\n", "hello world", "<1>1 newline\n", "<2>1 eof"} {
+		frame, err := readSyslogFrame(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(frame))
+	}
+	_, err := readSyslogFrame(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadSyslogFrameInvalid(t *testing.T) {
+	for _, test := range []string{"12x <1>1 -", "99999999 <1>1 -", "10 short", "12345"} {
+		_, err := readSyslogFrame(bufio.NewReaderSize(strings.NewReader(test), syslogMaxFrameLength))
+		assert.Error(t, err, test)
+	}
+}
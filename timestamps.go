@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+	"github.com/kiskolabs/heroku-cloudwatch-drain/metrics"
+)
+
+// CloudWatch Logs rejects events older than 14 days or more than 2 hours in
+// the future. The oldest accepted time leaves an hour for entries to wait in
+// queues.
+const (
+	timestampMaxAge    = 14*24*time.Hour - time.Hour
+	timestampMaxFuture = 2 * time.Hour
+)
+
+var timestampsOutOfRange = metrics.NewCounterVec(
+	"drain_timestamps_out_of_range_total",
+	"Entries with timestamps CloudWatch Logs doesn't accept, by what was done with them.",
+	"action",
+)
+
+// Actions for entries with out of range timestamps.
+const (
+	// timestampKeep leaves the entries as they are.
+	timestampKeep = "keep"
+	// timestampClamp sets the time of the entries to the time they are
+	// written.
+	timestampClamp = "clamp"
+	// timestampReroute clamps the time of the entries and sends them to a
+	// separate log group.
+	timestampReroute = "reroute"
+)
+
+// timestampAction is an action for entries with out of range timestamps. It
+// implements flag.Value to check that the action is known.
+type timestampAction string
+
+func (a *timestampAction) String() string {
+	return string(*a)
+}
+
+func (a *timestampAction) Set(value string) error {
+	switch value {
+	case timestampKeep, timestampClamp, timestampReroute:
+		*a = timestampAction(value)
+		return nil
+	}
+	return fmt.Errorf("unknown action %q, must be %s, %s or %s", value, timestampKeep, timestampClamp, timestampReroute)
+}
+
+// A timestampPolicy decides what to do with entries with timestamps out of
+// the range CloudWatch Logs accepts. The zero value keeps them as they are.
+type timestampPolicy struct {
+	action timestampAction
+
+	// group is the log group entries are rerouted to. The placeholder
+	// {group} is replaced with the log group of the entry.
+	group string
+}
+
+// apply checks the timestamp of an entry written at the given time, and
+// returns the log group it should be sent to. Clamped entries keep their
+// original timestamp at the start of their message. The entry is modified, so
+// it must be a copy of an entry shared with other loggers.
+func (p timestampPolicy) apply(group string, e *logparser.LogEntry, now time.Time) string {
+	if p.action == "" || p.action == timestampKeep {
+		return group
+	}
+	if !e.Time.Before(now.Add(-timestampMaxAge)) && !e.Time.After(now.Add(timestampMaxFuture)) {
+		return group
+	}
+	timestampsOutOfRange.With(string(p.action)).Inc()
+
+	original := e.Time.UTC().Format(time.RFC3339Nano)
+	e.Message = "[original timestamp " + original + "] " + e.Message
+	e.Time = now
+
+	if p.action == timestampReroute {
+		return strings.Replace(p.group, "{group}", group, -1)
+	}
+	return group
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kiskolabs/heroku-cloudwatch-drain/logparser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampAction(t *testing.T) {
+	var a timestampAction
+	assert.NoError(t, a.Set("reroute"))
+	assert.Equal(t, "reroute", a.String())
+	assert.EqualError(t, a.Set("drop"), `unknown action "drop", must be keep, clamp or reroute`)
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	now := time.Date(2017, 10, 15, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-15 * 24 * time.Hour)
+	future := now.Add(3 * time.Hour)
+
+	tests := []struct {
+		policy  timestampPolicy
+		time    time.Time
+		group   string
+		clamped bool
+	}{
+		{timestampPolicy{}, old, "app", false},
+		{timestampPolicy{action: timestampKeep}, future, "app", false},
+		{timestampPolicy{action: timestampClamp}, now.Add(-13 * 24 * time.Hour), "app", false},
+		{timestampPolicy{action: timestampClamp}, now.Add(time.Hour), "app", false},
+		{timestampPolicy{action: timestampClamp}, old, "app", true},
+		{timestampPolicy{action: timestampClamp}, future, "app", true},
+		{timestampPolicy{action: timestampReroute, group: "{group}/out-of-range"}, old, "app/out-of-range", true},
+		{timestampPolicy{action: timestampReroute, group: "late"}, future, "late", true},
+	}
+	for _, test := range tests {
+		e := &logparser.LogEntry{Time: test.time, Message: "hello"}
+		group := test.policy.apply("app", e, now)
+		assert.Equal(t, test.group, group)
+		if test.clamped {
+			original := test.time.Format(time.RFC3339Nano)
+			assert.Equal(t, now, e.Time)
+			assert.Equal(t, "[original timestamp "+original+"] hello", e.Message)
+		} else {
+			assert.Equal(t, test.time, e.Time)
+			assert.Equal(t, "hello", e.Message)
+		}
+	}
+}
+
+func TestTimestampReroute(t *testing.T) {
+	fake := &FakeCloudWatchLogs{groups: map[string]*fakeLogGroup{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newCloudWatchSinkForClient(&sinkConfig{
+		timestamps: timestampPolicy{action: timestampReroute, group: "{group}/out-of-range"},
+	}, newTestCloudWatchClient(server.URL))
+	count := timestampsOutOfRange.With(timestampReroute).Value()
+
+	l, err := s.logger("cron")
+	assert.NoError(t, err)
+	replayed := time.Date(2016, 10, 15, 8, 59, 8, 0, time.UTC)
+	e := &logparser.LogEntry{Time: replayed, Message: "replayed"}
+	l.Log(e)
+	l.Log(&logparser.LogEntry{Time: time.Now(), Message: "current"})
+	l.Close()
+
+	fake.mu.Lock()
+	assert.Equal(t, []string{"current"}, fake.messages["cron"])
+	assert.Equal(t, []string{"[original timestamp 2016-10-15T08:59:08Z] replayed"}, fake.messages["cron/out-of-range"])
+	fake.mu.Unlock()
+	assert.Equal(t, int64(1), timestampsOutOfRange.With(timestampReroute).Value()-count)
+
+	// The entry is left as it was for the loggers of other sinks.
+	assert.Equal(t, replayed, e.Time)
+	assert.Equal(t, "replayed", e.Message)
+}